@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// http basic authentication with the users and the passwords of an
+// htpasswd file, the passwords are hashed with bcrypt ($2y$) or sha1
+// ({SHA}). The files are read again when they change
+
+const shaPrefix = "{SHA}"
+
+// htpasswd is the users of a file and their hashed passwords
+type htpasswd struct {
+	users   map[string]string
+	modTime time.Time
+	size    int64
+}
+
+// authFiles has the htpasswd files that were read, by name
+type authFiles struct {
+	mu    sync.Mutex
+	files map[string]*htpasswd
+}
+
+func newAuthFiles() *authFiles {
+	return &authFiles{files: make(map[string]*htpasswd)}
+}
+
+// users returns the users of the file, it's read again when it changed
+// since the last time, or the first time that it's needed
+func (a *authFiles) users(name string) (map[string]string, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, ok := a.files[name]
+	if ok && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f.users, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	users := parseHtpasswd(name, b)
+	a.files[name] = &htpasswd{users: users, modTime: info.ModTime(), size: info.Size()}
+	return users, nil
+}
+
+// checkAuthFiles checks that the user files of the servers and of their
+// locations can be read, a missing one would fail every request
+func checkAuthFiles(conf *Conf) error {
+	a := newAuthFiles()
+	for _, srv := range conf.servers() {
+		confs := []*ServerConf{srv}
+		for i := range srv.Locations {
+			confs = append(confs, &srv.Locations[i].Server)
+		}
+		for _, s := range confs {
+			if !s.authBasic() {
+				continue
+			}
+			if _, err := a.users(s.AuthBasicUserFile); err != nil {
+				return fmt.Errorf("error reading the %s: %w", authBasicUserFileOption, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseHtpasswd parses the lines of the file (user:hash), the
+// users with a hash that is not supported are skipped
+func parseHtpasswd(name string, b []byte) map[string]string {
+	users := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			log.Printf("%s:%d: expected user:password", name, n)
+			continue
+		}
+		if !isBcrypt(hash) && !strings.HasPrefix(hash, shaPrefix) {
+			log.Printf("%s:%d: the password of %s is not hashed with bcrypt or sha1", name, n, user)
+			continue
+		}
+		users[user] = hash
+	}
+	return users
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// checkPassword reports whether the password matches the hash
+func checkPassword(hash, password string) bool {
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	if strings.HasPrefix(hash, shaPrefix) {
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(hash, shaPrefix)), []byte(want)) == 1
+	}
+	return false
+}
+
+// basicAuth returns the user and the password of the Authorization header
+func basicAuth(header string) (string, string, bool) {
+	scheme, credentials, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return "", "", false
+	}
+	user, password, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", "", false
+	}
+	return user, password, true
+}
+
+// authenticate returns the user of the request when it has the password
+// of one of the users of the file of the server, it's empty otherwise
+func (a *authFiles) authenticate(req *Request, srv *ServerConf) (string, error) {
+	users, err := a.users(srv.AuthBasicUserFile)
+	if err != nil {
+		return "", err
+	}
+	user, password, ok := basicAuth(req.Headers.Get("Authorization"))
+	if !ok {
+		return "", nil
+	}
+	hash, ok := users[user]
+	if !ok || !checkPassword(hash, password) {
+		return "", nil
+	}
+	return user, nil
+}
+
+// unauthorizedResponse is the response of a request without
+// the password of a user, it tells the client to send one
+func unauthorizedResponse(srv *ServerConf) *Response {
+	res := errorResponse(srv, StatusUnauthorized)
+	realm := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(srv.AuthBasic)
+	res.Headers.Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm))
+	return res
+}
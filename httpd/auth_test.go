@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the {SHA} hash of "secret"
+const shaSecret = "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tests := []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		{string(bcryptHash), "secret", true},
+		{string(bcryptHash), "wrong", false},
+		// htpasswd -B writes $2y$ hashes
+		{"$2y$" + string(bcryptHash[4:]), "secret", true},
+		{shaSecret, "secret", true},
+		{shaSecret, "wrong", false},
+		{"secret", "secret", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		if got := checkPassword(test.hash, test.password); got != test.want {
+			t.Errorf("checkPassword(%q, %q) returned %v but want %v", test.hash, test.password, got, test.want)
+		}
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	file := "# users\nalice:" + shaSecret + "\n\nbob:$2y$05$abc\ncarol:plain\nbroken\n:nobody\n"
+	users := parseHtpasswd("htpasswd", []byte(file))
+	if len(users) != 2 || users["alice"] != shaSecret || users["bob"] != "$2y$05$abc" {
+		t.Errorf("parseHtpasswd() returned %v, want alice and bob", users)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		header   string
+		user     string
+		password string
+		ok       bool
+	}{
+		{"Basic " + encode("alice:secret"), "alice", "secret", true},
+		{"basic " + encode("alice:se:cret"), "alice", "se:cret", true},
+		{"Basic " + encode("alice"), "", "", false},
+		{"Basic !!!", "", "", false},
+		{"Bearer " + encode("alice:secret"), "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		user, password, ok := basicAuth(test.header)
+		if user != test.user || password != test.password || ok != test.ok {
+			t.Errorf("basicAuth(%q) returned %q, %q, %v but want %q, %q, %v", test.header, user, password, ok, test.user, test.password, test.ok)
+		}
+	}
+}
+
+func TestAuthFilesAreReloaded(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(name, []byte("alice:"+shaSecret+"\n"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	a := newAuthFiles()
+	users, err := a.users(name)
+	if err != nil || users["alice"] == "" {
+		t.Fatalf("users() returned %v, %v, want alice", users, err)
+	}
+	if err := os.WriteFile(name, []byte("bob:"+shaSecret+"\n"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	// the size is the same, the time tells that it changed
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(name, later, later); err != nil {
+		t.Fatalf("%s", err)
+	}
+	users, err = a.users(name)
+	if err != nil || users["bob"] == "" || users["alice"] != "" {
+		t.Errorf("users() returned %v, %v, want bob only", users, err)
+	}
+	os.Remove(name)
+	if _, err := a.users(name); err == nil {
+		t.Errorf("users() of a missing file should fail")
+	}
+}
+
+func TestCheckAuthFiles(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(name, []byte("alice:"+shaSecret+"\n"), 0644); err != nil {
+		t.Fatalf("%s", err)
+	}
+	conf := &Conf{DefaultServer: &ServerConf{AuthBasic: "Admin", AuthBasicUserFile: name}}
+	if err := checkAuthFiles(conf); err != nil {
+		t.Errorf("checkAuthFiles() returned %s", err)
+	}
+	// a location that turns auth off doesn't need its file
+	conf.DefaultServer.Locations = []Location{{Server: ServerConf{AuthBasic: "off", AuthBasicUserFile: name + ".missing"}}}
+	if err := checkAuthFiles(conf); err != nil {
+		t.Errorf("checkAuthFiles() returned %s", err)
+	}
+	conf.DefaultServer.Locations[0].Server.AuthBasic = "Private"
+	if err := checkAuthFiles(conf); err == nil {
+		t.Errorf("checkAuthFiles() should fail for a missing file")
+	}
+}
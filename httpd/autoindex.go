@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listing of the directories that don't have an index page, it's sent as
+// html or as json for the clients that ask for it in the Accept header. The
+// html listing is sorted by the "sort" and "order" parameters of the query
+
+const (
+	sortByName  = "name"
+	sortBySize  = "size"
+	sortByMtime = "mtime"
+	orderAsc    = "asc"
+	orderDesc   = "desc"
+)
+
+const autoindexTimeFormat = "2006-01-02 15:04"
+
+// dirEntry is a file (or a directory) of the listing
+type dirEntry struct {
+	Name  string    `json:"name"`
+	Dir   bool      `json:"dir"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// autoindexResponse returns the listing of the directory, the uri of a
+// directory must end with a slash for the links to be relative to it
+func autoindexResponse(req *Request, srv *ServerConf, dir string) (*Response, error) {
+	u, err := url.ParseRequestURI(req.Uri)
+	if err != nil {
+		return NewResponse(StatusNotFound, nil, nil, 0), nil
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		loc := u.EscapedPath() + "/"
+		if u.RawQuery != "" {
+			loc += "?" + u.RawQuery
+		}
+		return redirectResponse(StatusMovedPermanently, loc), nil
+	}
+	entries, err := readDir(dir, srv.autoindexHidden())
+	if err != nil {
+		return openErrorResponse(err)
+	}
+	query := u.Query()
+	sortBy, order := query.Get("sort"), query.Get("order")
+	sortEntries(entries, sortBy, order)
+
+	headers := make(textproto.MIMEHeader)
+	headers.Set("Vary", "Accept")
+	var body []byte
+	if acceptsJSON(req.Headers.Get("Accept")) {
+		if body, err = json.Marshal(entries); err != nil {
+			return nil, err
+		}
+		headers.Set("Content-Type", "application/json")
+	} else {
+		body = autoindexHTML(u.Path, entries, sortBy, order)
+		headers.Set("Content-Type", "text/html; charset=utf-8")
+	}
+	return NewResponse(StatusOk, headers, bytes.NewReader(body), int64(len(body))), nil
+}
+
+// readDir returns the entries of the directory, the symlinks are
+// listed as what they point to and the broken ones are skipped
+func readDir(dir string, hidden bool) ([]dirEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]dirEntry, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if !hidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		e := dirEntry{Name: name, Dir: info.IsDir(), Mtime: info.ModTime().UTC()}
+		if !e.Dir {
+			e.Size = info.Size()
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// sortEntries sorts the entries by the name, the size or the modification
+// time, by the name when it's not one of them, the directories go first
+func sortEntries(entries []dirEntry, sortBy, order string) {
+	less := func(a, b dirEntry) bool { return a.Name < b.Name }
+	switch sortBy {
+	case sortBySize:
+		less = func(a, b dirEntry) bool {
+			if a.Size == b.Size {
+				return a.Name < b.Name
+			}
+			return a.Size < b.Size
+		}
+	case sortByMtime:
+		less = func(a, b dirEntry) bool {
+			if a.Mtime.Equal(b.Mtime) {
+				return a.Name < b.Name
+			}
+			return a.Mtime.Before(b.Mtime)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Dir != b.Dir {
+			return a.Dir
+		}
+		if order == orderDesc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+}
+
+// acceptsJSON reports whether the client prefers json over html, the
+// q-values of Accept work the same as the ones of Accept-Encoding
+func acceptsJSON(header string) bool {
+	return acceptedEncoding(header, "text/html", "application/json") == "application/json"
+}
+
+// autoindexHTML returns the html listing of the directory, the headers
+// of the columns sort it by them (in the other order when it already is)
+func autoindexHTML(dirPath string, entries []dirEntry, sortBy, order string) []byte {
+	if sortBy != sortBySize && sortBy != sortByMtime {
+		sortBy = sortByName
+	}
+	column := func(name, title string) string {
+		o := orderAsc
+		if name == sortBy && order != orderDesc {
+			o = orderDesc
+		}
+		return fmt.Sprintf(`<th><a href="?sort=%s&amp;order=%s">%s</a></th>`, name, o, title)
+	}
+	title := html.EscapeString("Index of " + dirPath)
+	var b strings.Builder
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>%s</title></head>\n<body>\n<h1>%s</h1>\n<table>\n", title, title)
+	fmt.Fprintf(&b, "<tr>%s%s%s</tr>\n", column(sortByName, "Name"), column(sortByMtime, "Last modified"), column(sortBySize, "Size"))
+	if dirPath != "/" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+	for _, e := range entries {
+		name, size := e.Name, strconv.FormatInt(e.Size, 10)
+		if e.Dir {
+			name, size = name+"/", "-"
+		}
+		// a name with a colon would be taken as the scheme of the link
+		href := "./" + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), e.Mtime.Format(autoindexTimeFormat), size)
+	}
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", ".hidden", "sub/b.txt"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatalf("%s", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("hello"), 0644); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	os.Symlink("missing", filepath.Join(dir, "broken"))
+	tests := []struct {
+		hidden bool
+		want   []string
+	}{
+		{false, []string{"a.txt", "sub"}},
+		{true, []string{".hidden", "a.txt", "sub"}},
+	}
+	for _, test := range tests {
+		entries, err := readDir(dir, test.hidden)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+			if e.Name == "sub" && (!e.Dir || e.Size != 0) {
+				t.Errorf("sub should be a directory without a size, got %+v", e)
+			}
+			if e.Name == "a.txt" && (e.Dir || e.Size != 5) {
+				t.Errorf("a.txt should be a file of 5 bytes, got %+v", e)
+			}
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("readDir(hidden=%v) returned %v but want %v", test.hidden, names, test.want)
+		}
+	}
+}
+
+func TestSortEntries(t *testing.T) {
+	now := time.Now()
+	entries := []dirEntry{
+		{Name: "b", Size: 1, Mtime: now},
+		{Name: "dir", Dir: true, Mtime: now},
+		{Name: "a", Size: 3, Mtime: now.Add(-time.Hour)},
+		{Name: "c", Size: 2, Mtime: now.Add(time.Hour)},
+	}
+	tests := []struct {
+		sortBy string
+		order  string
+		want   []string
+	}{
+		{"", "", []string{"dir", "a", "b", "c"}},
+		{"name", "desc", []string{"dir", "c", "b", "a"}},
+		{"size", "asc", []string{"dir", "b", "c", "a"}},
+		{"size", "desc", []string{"dir", "a", "c", "b"}},
+		{"mtime", "", []string{"dir", "a", "b", "c"}},
+		{"mtime", "desc", []string{"dir", "c", "b", "a"}},
+		{"unknown", "", []string{"dir", "a", "b", "c"}},
+	}
+	for _, test := range tests {
+		sortEntries(entries, test.sortBy, test.order)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("sortEntries(%q, %q) returned %v but want %v", test.sortBy, test.order, names, test.want)
+		}
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", true},
+		{"text/html, application/json", false},
+		{"text/html;q=0.5, application/json", true},
+		{"text/html,application/xhtml+xml,*/*;q=0.8", false},
+	}
+	for _, test := range tests {
+		if got := acceptsJSON(test.header); got != test.want {
+			t.Errorf("acceptsJSON(%q) returned %v but want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestAutoindexHTML(t *testing.T) {
+	entries := []dirEntry{
+		{Name: "<b>.txt", Size: 12},
+		{Name: "a:b", Size: 1},
+		{Name: "sub dir", Dir: true},
+	}
+	page := string(autoindexHTML("/files/", entries, "size", "asc"))
+	for _, want := range []string{
+		"<title>Index of /files/</title>",
+		`<a href="../">../</a>`,
+		`<a href="./%3Cb%3E.txt">&lt;b&gt;.txt</a>`,
+		`<a href="./a:b">a:b</a>`,
+		`<a href="./sub%20dir/">sub dir/</a>`,
+		`<a href="?sort=size&amp;order=desc">Size</a>`,
+		`<a href="?sort=name&amp;order=asc">Name</a>`,
+		"<td>12</td>",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("the listing does not have %q:\n%s", want, page)
+		}
+	}
+	if page := string(autoindexHTML("/", nil, "", "")); strings.Contains(page, "../") {
+		t.Errorf("the root should not link to its parent:\n%s", page)
+	}
+}
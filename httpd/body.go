@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// readers for the body of a request
+
+var (
+	ErrInvalidChunkedBody = errors.New("invalid chunked body")
+	ErrBodyTooLarge       = errors.New("request body too large")
+)
+
+// eofReader is the body of a request without one
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// chunkedReader decodes a body sent with "Transfer-Encoding: chunked",
+// the trailers after the last chunk are set on the request (if any)
+type chunkedReader struct {
+	req *Request
+	tr  *textproto.Reader
+	n   int64 // bytes left in the current chunk
+	err error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.n == 0 {
+		c.n, c.err = c.readChunkSize()
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.n == 0 {
+			// the last chunk is followed by the trailers
+			trailers, err := c.readTrailers()
+			if err != nil {
+				if err != ErrHeadersTooLarge {
+					err = ErrInvalidChunkedBody
+				}
+				c.err = err
+				return 0, c.err
+			}
+			if c.req != nil {
+				c.req.Trailers = trailers
+			}
+			c.err = io.EOF
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.n {
+		p = p[:c.n]
+	}
+	n, err := c.tr.R.Read(p)
+	c.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && c.n == 0 {
+		// the data of every chunk ends with a CRLF
+		if line, lerr := c.tr.ReadLine(); lerr != nil || line != "" {
+			err = ErrInvalidChunkedBody
+		}
+	}
+	c.err = err
+	return n, err
+}
+
+// readTrailers reads the trailers after the last chunk, the ones
+// of a request have the same limits as the headers
+func (c *chunkedReader) readTrailers() (textproto.MIMEHeader, error) {
+	if c.req != nil {
+		return c.req.readHeaders()
+	}
+	return c.tr.ReadMIMEHeader()
+}
+
+// readChunkSize reads the line with the size of the
+// next chunk, chunk extensions are ignored
+func (c *chunkedReader) readChunkSize() (int64, error) {
+	line, err := c.tr.ReadLine()
+	if err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if i := strings.IndexByte(line, ';'); i != -1 {
+		line = line[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidChunkedBody
+	}
+	return n, nil
+}
+
+// maxBodyReader fails with ErrBodyTooLarge
+// when more than n bytes are read
+type maxBodyReader struct {
+	r io.Reader
+	n int64 // bytes left
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// reading one more byte tells if there's more than allowed
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n + int(m.n), ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// continueReader sends the "100 Continue" response
+// the first time that the body is read
+type continueReader struct {
+	r    io.Reader
+	w    io.Writer
+	sent bool
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	if err := c.sendContinue(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// sendContinue sends the "100 Continue" response if it was not sent
+// yet, the body can be read later by another goroutine without writing
+// to the connection while the response is being written
+func (c *continueReader) sendContinue() error {
+	if c.sent {
+		return nil
+	}
+	c.sent = true
+	msg, _ := GetStatusCodeMessage(StatusContinue)
+	res := &Response{
+		HTTPVersionMajor: HTTPVersionMajor,
+		HTTPVersionMinor: HTTPVersionMinor,
+		Code:             StatusContinue,
+		Message:          msg,
+		Headers:          make(textproto.MIMEHeader),
+	}
+	return res.Write(c.w, nil)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// compression of the responses with gzip or deflate, the encoding is chosen
+// from the Accept-Encoding header and the body is compressed while it's sent
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// the responses smaller than this are not worth compressing
+const defaultCompressionMinSize = 256
+
+var defaultCompressionTypes = []string{
+	"text/html",
+	"text/css",
+	"text/plain",
+	"text/xml",
+	"application/javascript",
+	"application/json",
+	"image/svg+xml",
+}
+
+// acceptedEncoding returns the encoding of the header with the highest
+// q-value out of the ones in the list (which are in order of preference),
+// it's empty when none of them are accepted
+func acceptedEncoding(header string, encodings ...string) string {
+	if header == "" {
+		return ""
+	}
+	qs := make(map[string]float64)
+	for _, v := range strings.Split(header, ",") {
+		fields := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			k, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(strings.TrimSpace(k)) != "q" {
+				continue
+			}
+			n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || n < 0 || n > 1 {
+				n = 0
+			}
+			q = n
+		}
+		qs[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, enc := range encodings {
+		q, ok := qs[enc]
+		if !ok {
+			// the encodings that are not listed get the q-value of "*"
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressesType reports whether the responses with the content type
+// are compressed by the server, the parameters of the type are ignored
+func (s *ServerConf) compressesType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := s.CompressionTypes
+	if types == nil {
+		types = defaultCompressionTypes
+	}
+	for _, t := range types {
+		if strings.EqualFold(t, mediaType) || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressResponse sets the response to be compressed with the encoding that
+// the client prefers, the responses that are too small, that have a type that
+// is not compressed or that are already encoded are sent as they are
+func compressResponse(req *Request, srv *ServerConf, res *Response) {
+	if srv == nil || !srv.compresses() || req == nil || res == nil {
+		return
+	}
+	if !res.hasBody() || res.Code == StatusPartialContent || res.Headers.Get("Content-Encoding") != "" {
+		return
+	}
+	if !srv.compressesType(res.Headers.Get("Content-Type")) {
+		return
+	}
+	// the response changes with the header even when it's not compressed
+	addVary(res, "Accept-Encoding")
+	if res.ContentLength >= 0 && res.ContentLength < srv.compressionMinSize() {
+		return
+	}
+	// HTTP/1.0 clients don't know about chunks
+	if req.HTTPVersionMajor == 1 && req.HTTPVersionMinor == 0 {
+		return
+	}
+	enc := acceptedEncoding(req.Headers.Get("Accept-Encoding"), encodingGzip, encodingDeflate)
+	if enc == "" {
+		return
+	}
+	res.encoding = enc
+	res.ContentLength = -1
+	res.Headers.Del("Content-Length")
+	res.Headers.Set("Content-Encoding", enc)
+	// the ranges would be of the compressed body
+	res.Headers.Del("Accept-Ranges")
+	// the compressed body is not the same bytes as the file
+	if etag := res.Headers.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Headers.Set("ETag", "W/"+etag)
+	}
+}
+
+func addVary(res *Response, header string) {
+	for _, v := range res.Headers.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(h), header) {
+				return
+			}
+		}
+	}
+	res.Headers.Add("Vary", header)
+}
+
+// precompressedFile returns the .gz file that is next to the file, it's
+// sent instead of compressing the file for the clients that accept gzip
+func precompressedFile(req *Request, srv *ServerConf, name string) (*os.File, os.FileInfo, bool) {
+	if !srv.compressionStatic() || !srv.compressesType(getContentType(name)) {
+		return nil, nil, false
+	}
+	if acceptedEncoding(req.Headers.Get("Accept-Encoding"), encodingGzip) == "" {
+		return nil, nil, false
+	}
+	if !underRoot(name+".gz", srv.Root) {
+		return nil, nil, false
+	}
+	f, err := os.Open(name + ".gz")
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, false
+	}
+	return f, info, true
+}
+
+// newCompressor returns a writer that compresses with the encoding
+func newCompressor(enc string, w io.Writer) io.WriteCloser {
+	if enc == encodingDeflate {
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// countWriter counts the bytes that are written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
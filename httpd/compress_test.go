@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestAcceptedEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"GZIP; Q=0.8", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"*;q=0.1", "gzip"},
+		{"br, identity", ""},
+		{"gzip;q=abc", ""},
+	}
+	for _, test := range tests {
+		if got := acceptedEncoding(test.header, encodingGzip, encodingDeflate); got != test.want {
+			t.Errorf("acceptedEncoding(%q) returned %q but want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestCompressesType(t *testing.T) {
+	srv := &ServerConf{}
+	if !srv.compressesType("text/html; charset=utf-8") {
+		t.Errorf("html should be compressed by default")
+	}
+	if srv.compressesType("image/png") {
+		t.Errorf("png should not be compressed by default")
+	}
+	srv.CompressionTypes = []string{"image/png"}
+	if !srv.compressesType("image/png") || srv.compressesType("text/html") {
+		t.Errorf("only the configured types should be compressed")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// conditional requests for the static files (RFC 7232), the clients send
+// back the ETag or the Last-Modified date of a file to know if it changed
+
+// the kinds of ETags that are sent for the static files
+const (
+	etagStrong = "strong"
+	etagWeak   = "weak"
+	etagOff    = "off"
+)
+
+// fileETag returns the ETag of a file, it changes whenever the
+// file is modified or its size changes
+func fileETag(info fs.FileInfo, kind string) string {
+	tag := fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size())
+	switch kind {
+	case etagOff:
+		return ""
+	case etagWeak:
+		return "W/" + tag
+	}
+	return tag
+}
+
+// checkPreconditions evaluates the conditional headers of the request in the
+// order of RFC 7232 section 6, it returns 304 or 412 when the file must not
+// be sent and 0 otherwise
+func checkPreconditions(req *Request, etag string, modTime time.Time) int {
+	isGetOrHead := req.Method == RequestMethodGet || req.Method == RequestMethodHead
+	if im := req.Headers.Get("If-Match"); im != "" {
+		if !etagMatches(im, etag, false) {
+			return StatusPreconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(req.Headers.Get("If-Unmodified-Since")); ok && modifiedSince(modTime, t) {
+		return StatusPreconditionFailed
+	}
+	if inm := req.Headers.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag, true) {
+			if isGetOrHead {
+				return StatusNotModified
+			}
+			return StatusPreconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(req.Headers.Get("If-Modified-Since")); ok && isGetOrHead && !modifiedSince(modTime, t) {
+		return StatusNotModified
+	}
+	return 0
+}
+
+// etagMatches reports whether the etag is in the list of the header, the weak
+// comparison ignores the W/ prefix and the strong one never matches a weak tag
+func etagMatches(header string, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		// any version of the file
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince reports whether the file was modified after t,
+// the dates of the headers don't have fractions of a second
+func modifiedSince(modTime time.Time, t time.Time) bool {
+	return modTime.Truncate(time.Second).After(t)
+}
+
+// parseHTTPDate parses a date of a header, the invalid dates are ignored
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{timeFormat, time.RFC850, time.ANSIC} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	modTime := time.Date(2022, time.March, 10, 12, 30, 0, 500, time.UTC)
+	etag := `"62296d58-c"`
+	before := "Wed, 09 Mar 2022 12:30:00 GMT"
+	same := "Thu, 10 Mar 2022 12:30:00 GMT"
+	after := "Fri, 11 Mar 2022 12:30:00 GMT"
+	tests := []struct {
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"GET", nil, 0},
+		{"GET", map[string]string{"If-None-Match": etag}, StatusNotModified},
+		{"HEAD", map[string]string{"If-None-Match": `"other", ` + etag}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": "W/" + etag}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": "*"}, StatusNotModified},
+		{"GET", map[string]string{"If-None-Match": `"other"`}, 0},
+		{"PUT", map[string]string{"If-None-Match": etag}, StatusPreconditionFailed},
+		{"GET", map[string]string{"If-Modified-Since": same}, StatusNotModified},
+		{"GET", map[string]string{"If-Modified-Since": after}, StatusNotModified},
+		{"GET", map[string]string{"If-Modified-Since": before}, 0},
+		{"GET", map[string]string{"If-Modified-Since": "yesterday"}, 0},
+		{"POST", map[string]string{"If-Modified-Since": same}, 0},
+		// If-None-Match wins over If-Modified-Since
+		{"GET", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, 0},
+		{"GET", map[string]string{"If-Match": etag}, 0},
+		{"GET", map[string]string{"If-Match": "W/" + etag}, StatusPreconditionFailed},
+		{"PUT", map[string]string{"If-Match": `"other"`}, StatusPreconditionFailed},
+		{"GET", map[string]string{"If-Unmodified-Since": same}, 0},
+		{"GET", map[string]string{"If-Unmodified-Since": before}, StatusPreconditionFailed},
+		// If-Match wins over If-Unmodified-Since
+		{"GET", map[string]string{"If-Match": etag, "If-Unmodified-Since": before}, 0},
+	}
+	for _, test := range tests {
+		req := &Request{Method: test.method, Headers: make(textproto.MIMEHeader)}
+		for k, v := range test.headers {
+			req.Headers.Set(k, v)
+		}
+		if got := checkPreconditions(req, etag, modTime); got != test.want {
+			t.Errorf("%s with %v returned %d but want %d", test.method, test.headers, got, test.want)
+		}
+	}
+	// a weak etag never passes the strong comparison of If-Match
+	req := &Request{Method: "GET", Headers: textproto.MIMEHeader{"If-Match": {"W/" + etag}}}
+	if got := checkPreconditions(req, "W/"+etag, modTime); got != StatusPreconditionFailed {
+		t.Errorf("a weak etag should not match If-Match, got %d", got)
+	}
+}
@@ -3,10 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // This is supposed to validate, test and parse the configuration file
@@ -17,19 +23,106 @@ const (
 	commentSign    = '#'
 )
 
+var ErrIncludeCycle = errors.New("include cycle")
+
+const (
+	nameOption        = "name"
+	rootOption        = "root"
+	portOption        = "port"
+	userOption        = "user"
+	groupOption       = "group"
+	indexOption       = "index"
+	errorPageOption   = "error_page"
+	errorLogOption    = "error_log"
+	accessLogOption   = "access_log"
+	includeOption     = "include"
+	vhostOption       = "vhost"
+	workersOption     = "workers"
+	pidFileOption     = "pid_file"
+	daemonOption      = "daemon"
+	maxBodySizeOption = "max_body_size"
+	logFormatOption   = "log_format"
+
+	sslCertificateOption    = "ssl_certificate"
+	sslCertificateKeyOption = "ssl_certificate_key"
+	tlsMinVersionOption     = "tls_min_version"
+	tlsCiphersOption        = "tls_ciphers"
+	httpsRedirectOption     = "https_redirect"
+
+	fastcgiPassOption    = "fastcgi_pass"
+	fastcgiMatchOption   = "fastcgi_match"
+	fastcgiTimeoutOption = "fastcgi_timeout"
+
+	proxyPassOption = "proxy_pass"
+	methodsOption   = "methods"
+	locationOption  = "location"
+	rewriteOption   = "rewrite"
+	returnOption    = "return"
+	etagOption      = "etag"
+
+	autoindexOption       = "autoindex"
+	autoindexHiddenOption = "autoindex_hidden"
+
+	authBasicOption         = "auth_basic"
+	authBasicUserFileOption = "auth_basic_user_file"
+
+	compressionOption        = "compression"
+	compressionTypesOption   = "compression_types"
+	compressionMinSizeOption = "compression_min_size"
+	compressionStaticOption  = "compression_static"
+
+	limitReqOption  = "limit_req"
+	limitConnOption = "limit_conn"
+
+	// the upstream blocks and their options
+	upstreamOption          = "upstream"
+	upstreamServerOption    = "server"
+	balanceOption           = "balance"
+	maxFailsOption          = "max_fails"
+	failTimeoutOption       = "fail_timeout"
+	upstreamKeepAliveOption = "keepalive"
+
+	shutdownTimeoutOption   = "shutdown_timeout"
+	keepAliveTimeoutOption  = "keepalive_timeout"
+	keepAliveRequestsOption = "keepalive_requests"
+
+	headerTimeoutOption  = "header_timeout"
+	bodyTimeoutOption    = "body_timeout"
+	writeTimeoutOption   = "write_timeout"
+	maxRequestLineOption = "max_request_line"
+	maxHeaderSizeOption  = "max_header_size"
+	maxHeadersOption     = "max_headers"
+)
+
+// the flag of a port that uses TLS, like "port = 80, 443 tls"
+const tlsPortFlag = "tls"
+
+const (
+	defaultKeepAliveTimeout  = 75 * time.Second
+	defaultKeepAliveRequests = 100
+	defaultMaxBodySize       = 1 << 20
+
+	defaultHeaderTimeout  = 60 * time.Second
+	defaultBodyTimeout    = 60 * time.Second
+	defaultWriteTimeout   = 60 * time.Second
+	defaultMaxRequestLine = 8 << 10
+	defaultMaxHeaderSize  = 32 << 10
+	defaultMaxHeaders     = 100
+
+	defaultFastCGITimeout = 60 * time.Second
+)
+
+// the ways to balance the requests between the servers of an upstream
 const (
-	nameOption      = "name"
-	rootOption      = "root"
-	portOption      = "port"
-	userOption      = "user"
-	groupOption     = "group"
-	indexOption     = "index"
-	errorPageOption = "error_page"
-	errorLogOption  = "error_log"
-	accessLogOption = "access_log"
-	includeOption   = "include"
-	vhostOption     = "vhost"
-	workersOption   = "workers"
+	balanceRoundRobin = "round_robin"
+	balanceLeastConn  = "least_conn"
+	balanceIPHash     = "ip_hash"
+)
+
+const (
+	defaultMaxFails          = 1
+	defaultFailTimeout       = 10 * time.Second
+	defaultUpstreamKeepAlive = 16
 )
 
 type Conf struct {
@@ -37,7 +130,36 @@ type Conf struct {
 	Group         string
 	DefaultServer *ServerConf
 	Vhosts        []ServerConf
-	Workers       int
+	Upstreams     []UpstreamConf
+
+	// the number of worker processes started by the master process, the
+	// server runs as a single process when it's not set
+	Workers int
+	// the file with the pid of the master process and "on"
+	// to run in the background, detached from the terminal
+	PidFile string
+	Daemon  string
+
+	// how long to wait for the active connections on shutdown
+	ShutdownTimeout time.Duration
+
+	// how long an idle connection is kept open and how many
+	// requests can be sent on it before it's closed
+	KeepAliveTimeout  time.Duration
+	KeepAliveRequests int
+
+	// how long the client can take to send the request line and the
+	// headers, and how long it can wait between the reads of the body
+	// and between the writes of the response
+	HeaderTimeout time.Duration
+	BodyTimeout   time.Duration
+	WriteTimeout  time.Duration
+
+	// the maximum size in bytes of the request line and of the
+	// headers, and how many headers a request can have
+	MaxRequestLine int64
+	MaxHeaderSize  int64
+	MaxHeaders     int
 }
 
 type ServerConf struct {
@@ -48,8 +170,85 @@ type ServerConf struct {
 	ErrorPages []ErrorPage
 	ErrorLog   string
 	AccessLog  string
+	// the maximum size in bytes of the body of a request
+	MaxBodySize int64
+	// the minimum level of the messages written to the error log
+	ErrorLogLevel string
+	// "common", "combined" or a format with variables
+	LogFormat string
+	// the ports of Ports that use TLS
+	TLSPorts []int
+	// the certificate and its key in PEM format
+	SSLCertificate    string
+	SSLCertificateKey string
+	// the minimum version of TLS ("1.2" by default) and
+	// the allowed cipher suites (the default ones when empty)
+	TLSMinVersion string
+	TLSCiphers    string
+	// "on" to redirect plain HTTP requests to HTTPS
+	HTTPSRedirect string
+	// the address of the FastCGI backend (host:port or unix:/path)
+	// and the extensions or path prefixes of the scripts it runs
+	FastCGIPass  string
+	FastCGIMatch []string
+	// how long to wait for each read or write of the FastCGI backend
+	FastCGITimeout time.Duration
+	// the url that the requests are proxied to, its host
+	// is either the name of an upstream or a single server
+	ProxyPass string
+	// the request methods that are allowed, every one when empty
+	Methods []string
+	// "strong" (the default), "weak" or "off"
+	ETag string
+	// "on" to list the directories without an index page, and
+	// "on" to list their hidden files (the ones that start with a dot)
+	Autoindex       string
+	AutoindexHidden string
+	// the realm of the users that can send requests, "off" to let
+	// anyone send them, and the htpasswd file with their passwords
+	AuthBasic         string
+	AuthBasicUserFile string
+	// "on" to compress the responses with gzip or deflate, only the ones
+	// with one of the types and that are at least of the minimum size
+	Compression        string
+	CompressionTypes   []string
+	CompressionMinSize int64
+	// "on" to send the .gz file next to a static file when it exists
+	CompressionStatic string
+	// the requests per second allowed to each client and how many more
+	// can be sent at once, and how many connections each client can have
+	// open, -1 when they're turned off
+	LimitRate  float64
+	LimitBurst int
+	LimitConn  int
+	// the server or location that set the limit of requests, the
+	// clients have the same limit everywhere that it's inherited
+	limitReqZone string
+	// the rewrite and return options in the order of the
+	// configuration, they're not inherited
+	Rewrites []Rewrite
+	// the location blocks of the server
+	Locations []Location
+	// the location of a configuration that was built for one
+	location *Location
+}
+
+// UpstreamConf is a group of servers that the requests are proxied to
+type UpstreamConf struct {
+	Name    string
+	Servers []string
+	// "round_robin" (the default), "least_conn" or "ip_hash"
+	Balance string
+	// a server is not used for FailTimeout once it fails MaxFails times in a row,
+	// an error or a 502, 503 or 504 response is a failure
+	MaxFails    int
+	FailTimeout time.Duration
+	// how many idle connections are kept open to each server
+	KeepAlive int
 }
 
+// ErrorPage is the page of a status code, the code of the
+// page of "error_page" is 0 since it's used for all of them
 type ErrorPage struct {
 	Code int
 	Page string
@@ -61,12 +260,12 @@ func Load(confFile string) (*Conf, error) {
 		log.Println(err)
 		return nil, err
 	}
-	file, err = parseIncludes(file)
+	file, lines, err := parseIncludes(file, confFile)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
-	err = checkForSyntaxErrors(file)
+	err = checkForSyntaxErrors(file, lines)
 	if err != nil {
 		log.Println(err)
 		return nil, err
@@ -79,10 +278,15 @@ func Load(confFile string) (*Conf, error) {
 	return conf, nil
 }
 
-func (c *Conf) addOption(opName string, opValue string) {
+func (c *Conf) defaultServer() *ServerConf {
 	if c.DefaultServer == nil {
 		c.DefaultServer = &ServerConf{}
 	}
+	return c.DefaultServer
+}
+
+func (c *Conf) addOption(opName string, opValue string) {
+	srv := c.defaultServer()
 	switch opName {
 	case userOption:
 		c.User = opValue
@@ -91,9 +295,117 @@ func (c *Conf) addOption(opName string, opValue string) {
 	case workersOption:
 		w, _ := strconv.Atoi(opValue)
 		c.Workers = w
+	case pidFileOption:
+		c.PidFile = opValue
+	case daemonOption:
+		c.Daemon = opValue
+	case shutdownTimeoutOption:
+		c.ShutdownTimeout, _ = parseDuration(opValue)
+	case keepAliveTimeoutOption:
+		c.KeepAliveTimeout, _ = parseDuration(opValue)
+	case keepAliveRequestsOption:
+		c.KeepAliveRequests, _ = strconv.Atoi(opValue)
+	case headerTimeoutOption:
+		c.HeaderTimeout, _ = parseDuration(opValue)
+	case bodyTimeoutOption:
+		c.BodyTimeout, _ = parseDuration(opValue)
+	case writeTimeoutOption:
+		c.WriteTimeout, _ = parseDuration(opValue)
+	case maxRequestLineOption:
+		c.MaxRequestLine, _ = parseSize(opValue)
+	case maxHeaderSizeOption:
+		c.MaxHeaderSize, _ = parseSize(opValue)
+	case maxHeadersOption:
+		c.MaxHeaders, _ = strconv.Atoi(opValue)
 	default:
-		c.DefaultServer.addOption(opName, opValue)
+		srv.addOption(opName, opValue)
+	}
+}
+
+func (c *Conf) pidFile() string {
+	if c.PidFile == "" {
+		return defaultPidFile
+	}
+	return c.PidFile
+}
+
+func (c *Conf) daemon() bool {
+	return c.Daemon == "on"
+}
+
+func (c *Conf) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return c.ShutdownTimeout
+}
+
+func (c *Conf) keepAliveTimeout() time.Duration {
+	if c.KeepAliveTimeout <= 0 {
+		return defaultKeepAliveTimeout
+	}
+	return c.KeepAliveTimeout
+}
+
+func (c *Conf) headerTimeout() time.Duration {
+	if c.HeaderTimeout <= 0 {
+		return defaultHeaderTimeout
+	}
+	return c.HeaderTimeout
+}
+
+func (c *Conf) bodyTimeout() time.Duration {
+	if c.BodyTimeout <= 0 {
+		return defaultBodyTimeout
+	}
+	return c.BodyTimeout
+}
+
+func (c *Conf) writeTimeout() time.Duration {
+	if c.WriteTimeout <= 0 {
+		return defaultWriteTimeout
+	}
+	return c.WriteTimeout
+}
+
+func (c *Conf) maxRequestLine() int {
+	if c.MaxRequestLine <= 0 {
+		return defaultMaxRequestLine
+	}
+	return int(c.MaxRequestLine)
+}
+
+func (c *Conf) maxHeaderSize() int {
+	if c.MaxHeaderSize <= 0 {
+		return defaultMaxHeaderSize
+	}
+	return int(c.MaxHeaderSize)
+}
+
+func (c *Conf) maxHeaders() int {
+	if c.MaxHeaders <= 0 {
+		return defaultMaxHeaders
+	}
+	return c.MaxHeaders
+}
+
+func (c *Conf) keepAliveRequests() int {
+	if c.KeepAliveRequests <= 0 {
+		return defaultKeepAliveRequests
 	}
+	return c.KeepAliveRequests
+}
+
+// servers returns the default server and every virtual host
+func (c *Conf) servers() []*ServerConf {
+	servers := make([]*ServerConf, 0, len(c.Vhosts)+1)
+	if c.DefaultServer != nil {
+		servers = append(servers, c.DefaultServer)
+	}
+	for i := range c.Vhosts {
+		servers = append(servers, &c.Vhosts[i])
+	}
+	return servers
 }
 
 func (c *Conf) addVhost(vhost ServerConf) {
@@ -114,9 +426,70 @@ func (s *ServerConf) addOption(opName string, opValue string) {
 	case indexOption:
 		s.parseIndexOptions(opValue)
 	case errorLogOption:
-		s.ErrorLog = opValue
+		// the file can be followed by the level
+		fields := strings.Fields(opValue)
+		if len(fields) > 0 {
+			s.ErrorLog = fields[0]
+		}
+		if len(fields) > 1 {
+			s.ErrorLogLevel = fields[1]
+		}
+	case logFormatOption:
+		s.LogFormat = opValue
 	case accessLogOption:
 		s.AccessLog = opValue
+	case maxBodySizeOption:
+		s.MaxBodySize, _ = parseSize(opValue)
+	case sslCertificateOption:
+		s.SSLCertificate = opValue
+	case sslCertificateKeyOption:
+		s.SSLCertificateKey = opValue
+	case tlsMinVersionOption:
+		s.TLSMinVersion = opValue
+	case tlsCiphersOption:
+		s.TLSCiphers = opValue
+	case httpsRedirectOption:
+		s.HTTPSRedirect = opValue
+	case fastcgiPassOption:
+		s.FastCGIPass = opValue
+	case fastcgiMatchOption:
+		s.FastCGIMatch = splitList(opValue)
+	case fastcgiTimeoutOption:
+		s.FastCGITimeout, _ = parseDuration(opValue)
+	case proxyPassOption:
+		s.ProxyPass = opValue
+	case methodsOption:
+		s.Methods = splitList(opValue)
+	case etagOption:
+		s.ETag = opValue
+	case autoindexOption:
+		s.Autoindex = opValue
+	case autoindexHiddenOption:
+		s.AutoindexHidden = opValue
+	case authBasicOption:
+		s.AuthBasic = opValue
+	case authBasicUserFileOption:
+		s.AuthBasicUserFile = opValue
+	case compressionOption:
+		s.Compression = opValue
+	case compressionTypesOption:
+		s.CompressionTypes = splitList(opValue)
+	case compressionMinSizeOption:
+		s.CompressionMinSize, _ = parseSize(opValue)
+	case compressionStaticOption:
+		s.CompressionStatic = opValue
+	case limitReqOption:
+		s.LimitRate, s.LimitBurst, _ = parseLimitReq(opValue)
+	case limitConnOption:
+		s.LimitConn, _ = parseLimitConn(opValue)
+	case rewriteOption:
+		if r, err := parseRewrite(opValue); err == nil {
+			s.Rewrites = append(s.Rewrites, r)
+		}
+	case returnOption:
+		if r, err := parseReturn(opValue); err == nil {
+			s.Rewrites = append(s.Rewrites, r)
+		}
 	}
 
 	// handle error pages
@@ -132,6 +505,10 @@ func (s *ServerConf) parseNameOptions(serverNames string) {
 	}
 	s.Names = make([]string, 0)
 	for _, n := range names {
+		n = strings.ToLower(strings.TrimSpace(n))
+		if n == "" {
+			continue
+		}
 		// don't include duplicated names
 		containsName := false
 		for _, n2 := range s.Names {
@@ -151,14 +528,34 @@ func (s *ServerConf) parsePortOptions(ports string) {
 		return
 	}
 	s.Ports = make([]int, 0)
+	s.TLSPorts = nil
 	for _, p := range portsStr {
-		pInt, err := strconv.Atoi(p)
+		// the port can be followed by the tls flag
+		fields := strings.Fields(p)
+		if len(fields) == 0 {
+			continue
+		}
+		pInt, err := strconv.Atoi(fields[0])
 		if err != nil {
 			log.Println(err)
 			return
 		}
 		s.Ports = append(s.Ports, pInt)
+		if len(fields) > 1 && fields[1] == tlsPortFlag {
+			s.TLSPorts = append(s.TLSPorts, pInt)
+		}
+	}
+}
+
+// splitList splits a list of values separated by commas
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
+	return list
 }
 
 func (s *ServerConf) parseIndexOptions(pages string) {
@@ -168,10 +565,286 @@ func (s *ServerConf) parseIndexOptions(pages string) {
 	}
 	s.IndexPages = make([]string, 0)
 	for _, p := range pagesSli {
-		s.IndexPages = append(s.IndexPages, p)
+		s.IndexPages = append(s.IndexPages, strings.TrimSpace(p))
 	}
 }
 
+// inherit sets the options that were not specified
+// in a virtual host from the ones in the default server
+func (s *ServerConf) inherit(parent *ServerConf) {
+	if parent == nil {
+		return
+	}
+	if s.Root == "" {
+		s.Root = parent.Root
+	}
+	if s.IndexPages == nil {
+		s.IndexPages = parent.IndexPages
+	}
+	if s.ErrorPages == nil {
+		s.ErrorPages = parent.ErrorPages
+	}
+	if s.ErrorLog == "" {
+		s.ErrorLog = parent.ErrorLog
+		s.ErrorLogLevel = parent.ErrorLogLevel
+	}
+	if s.AccessLog == "" {
+		s.AccessLog = parent.AccessLog
+	}
+	if s.MaxBodySize == 0 {
+		s.MaxBodySize = parent.MaxBodySize
+	}
+	if s.LogFormat == "" {
+		s.LogFormat = parent.LogFormat
+	}
+	// a key only makes sense with its own certificate
+	if s.SSLCertificate == "" {
+		s.SSLCertificate = parent.SSLCertificate
+		s.SSLCertificateKey = parent.SSLCertificateKey
+	}
+	if s.TLSMinVersion == "" {
+		s.TLSMinVersion = parent.TLSMinVersion
+	}
+	if s.TLSCiphers == "" {
+		s.TLSCiphers = parent.TLSCiphers
+	}
+	if s.HTTPSRedirect == "" {
+		s.HTTPSRedirect = parent.HTTPSRedirect
+	}
+	if s.ETag == "" {
+		s.ETag = parent.ETag
+	}
+	if s.Autoindex == "" {
+		s.Autoindex = parent.Autoindex
+	}
+	if s.AutoindexHidden == "" {
+		s.AutoindexHidden = parent.AutoindexHidden
+	}
+	if s.AuthBasic == "" {
+		s.AuthBasic = parent.AuthBasic
+	}
+	if s.AuthBasicUserFile == "" {
+		s.AuthBasicUserFile = parent.AuthBasicUserFile
+	}
+	if s.Compression == "" {
+		s.Compression = parent.Compression
+	}
+	if s.CompressionTypes == nil {
+		s.CompressionTypes = parent.CompressionTypes
+	}
+	if s.CompressionMinSize == 0 {
+		s.CompressionMinSize = parent.CompressionMinSize
+	}
+	if s.CompressionStatic == "" {
+		s.CompressionStatic = parent.CompressionStatic
+	}
+	if s.LimitRate == 0 {
+		s.LimitRate, s.LimitBurst = parent.LimitRate, parent.LimitBurst
+		s.limitReqZone = parent.limitReqZone
+	}
+	if s.LimitConn == 0 {
+		s.LimitConn = parent.LimitConn
+	}
+	if s.FastCGIPass == "" {
+		s.FastCGIPass = parent.FastCGIPass
+	}
+	if s.FastCGIMatch == nil {
+		s.FastCGIMatch = parent.FastCGIMatch
+	}
+	if s.FastCGITimeout == 0 {
+		s.FastCGITimeout = parent.FastCGITimeout
+	}
+	if s.ProxyPass == "" {
+		s.ProxyPass = parent.ProxyPass
+	}
+	if s.Methods == nil {
+		s.Methods = parent.Methods
+	}
+}
+
+func (s *ServerConf) errorLogLevel() int {
+	if level, ok := logLevels[s.ErrorLogLevel]; ok {
+		return level
+	}
+	return defaultLogLevel
+}
+
+func (s *ServerConf) logFormat() string {
+	if s.LogFormat == "" {
+		return defaultLogFormat
+	}
+	return s.LogFormat
+}
+
+func (s *ServerConf) tlsMinVersion() uint16 {
+	if v, ok := tlsVersions[s.TLSMinVersion]; ok {
+		return v
+	}
+	return defaultTLSMinVersion
+}
+
+// etag returns the kind of ETags sent for the static files
+func (s *ServerConf) etag() string {
+	if s.ETag == "" {
+		return etagStrong
+	}
+	return s.ETag
+}
+
+func (s *ServerConf) autoindex() bool {
+	return s.Autoindex == "on"
+}
+
+func (s *ServerConf) autoindexHidden() bool {
+	return s.AutoindexHidden == "on"
+}
+
+// authBasic reports whether the requests need the password of a user
+func (s *ServerConf) authBasic() bool {
+	return s.AuthBasic != "" && s.AuthBasic != "off"
+}
+
+func (s *ServerConf) compresses() bool {
+	return s.Compression == "on"
+}
+
+func (s *ServerConf) compressionStatic() bool {
+	return s.CompressionStatic == "on"
+}
+
+func (s *ServerConf) compressionMinSize() int64 {
+	if s.CompressionMinSize <= 0 {
+		return defaultCompressionMinSize
+	}
+	return s.CompressionMinSize
+}
+
+// setLimitZones names the request limits of every server and location after
+// the block that sets them, the names don't change with a reload so the
+// clients keep their limits
+func (c *Conf) setLimitZones() {
+	for _, srv := range c.servers() {
+		zone := "default"
+		if srv != c.DefaultServer {
+			zone = fmt.Sprintf("vhost %s %v", strings.Join(srv.Names, ","), srv.Ports)
+		}
+		srv.setLimitZone(zone)
+		for i := range srv.Locations {
+			loc := &srv.Locations[i]
+			loc.Server.setLimitZone(fmt.Sprintf("%s location %s %s", zone, loc.Match, loc.Path))
+		}
+	}
+}
+
+func (s *ServerConf) setLimitZone(zone string) {
+	if s.LimitRate > 0 {
+		s.limitReqZone = zone
+	}
+}
+
+func (s *ServerConf) redirectsToHTTPS() bool {
+	return s.HTTPSRedirect == "on"
+}
+
+func (s *ServerConf) usesTLS(port int) bool {
+	for _, p := range s.TLSPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServerConf) fastcgiTimeout() time.Duration {
+	if s.FastCGITimeout <= 0 {
+		return defaultFastCGITimeout
+	}
+	return s.FastCGITimeout
+}
+
+func (s *ServerConf) maxBodySize() int64 {
+	if s.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return s.MaxBodySize
+}
+
+// errorPage returns the page for the status code, the page of
+// "error_page" is used for every code without its own page
+func (s *ServerConf) errorPage(code int) string {
+	for _, p := range s.ErrorPages {
+		if p.Code == code {
+			return p.Page
+		}
+	}
+	for _, p := range s.ErrorPages {
+		if p.Code == 0 {
+			return p.Page
+		}
+	}
+	return ""
+}
+
+func (s *ServerConf) listensOn(port int) bool {
+	for _, p := range s.Ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// isNamed checks if the host matches any of the names of the server,
+// a name that starts with "*." matches any of its subdomains
+func (s *ServerConf) isNamed(host string) bool {
+	host = strings.ToLower(host)
+	for _, n := range s.Names {
+		if n == host {
+			return true
+		}
+		if strings.HasPrefix(n, "*.") && strings.HasSuffix(host, n[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *UpstreamConf) addOption(opName string, opValue string) {
+	switch opName {
+	case upstreamServerOption:
+		u.Servers = append(u.Servers, splitList(opValue)...)
+	case balanceOption:
+		u.Balance = opValue
+	case maxFailsOption:
+		u.MaxFails, _ = strconv.Atoi(opValue)
+	case failTimeoutOption:
+		u.FailTimeout, _ = parseDuration(opValue)
+	case upstreamKeepAliveOption:
+		u.KeepAlive, _ = strconv.Atoi(opValue)
+	}
+}
+
+func (u *UpstreamConf) maxFails() int {
+	if u.MaxFails <= 0 {
+		return defaultMaxFails
+	}
+	return u.MaxFails
+}
+
+func (u *UpstreamConf) failTimeout() time.Duration {
+	if u.FailTimeout <= 0 {
+		return defaultFailTimeout
+	}
+	return u.FailTimeout
+}
+
+func (u *UpstreamConf) keepAlive() int {
+	if u.KeepAlive <= 0 {
+		return defaultUpstreamKeepAlive
+	}
+	return u.KeepAlive
+}
+
 func (s *ServerConf) parseErrorPageOptions(errorType, page string) {
 	eTypePieces := strings.Split(errorType, "_")
 	// unlikely, but just in case
@@ -196,43 +869,95 @@ func (s *ServerConf) parseErrorPageOptions(errorType, page string) {
 	}
 	if len(eTypePieces) == 2 {
 		errPage = ErrorPage{
-			Code: StatusBadRequest,
+			Code: 0,
 			Page: strings.TrimSpace(page),
 		}
 	}
 	s.ErrorPages = append(s.ErrorPages, errPage)
 }
 
+// confBlock is a block of the configuration that is being built,
+// the options inside of it are added to the server or the upstream
+type confBlock struct {
+	name     string
+	srv      *ServerConf
+	upstream *UpstreamConf
+	loc      *Location
+	parent   *ServerConf // the server of a location
+}
+
 func buildServerConf(file []byte) (*Conf, error) {
 	r := bytes.NewReader(file)
 	scanner := bufio.NewScanner(r)
-	insideVhost := false
 	conf := &Conf{}
-	var curVhost *ServerConf
+	// the blocks that are open, the innermost one is the last
+	blocks := make([]*confBlock, 0)
 	for scanner.Scan() {
-		line := scanner.Bytes()
-		if bytes.ContainsRune(line, equalSign) {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		// a block can have an equal sign, like "location = /exact {"
+		isBlock := line[len(line)-1] == openBracket
+		if !isBlock && bytes.ContainsRune(line, equalSign) {
 			// this is a line with an option
-			ops := bytes.Split(line, []byte{byte(equalSign)})
+			ops := bytes.SplitN(line, []byte{byte(equalSign)}, 2)
 			opName := string(bytes.TrimSpace(ops[0]))
 			opValue := string(bytes.TrimSpace(ops[1]))
-			if insideVhost {
-				// option for the current virtual host
-				curVhost.addOption(opName, opValue)
-			} else {
+			if len(blocks) == 0 {
 				// top level or global option
 				conf.addOption(opName, opValue)
+				continue
 			}
-		} else if bytes.Contains(line, []byte(vhostOption)) {
-			// this is a line with a vhost command
-			insideVhost = true
-			curVhost = &ServerConf{}
-		} else if bytes.ContainsRune(line, closingBracket) {
-			// closing bracket for a vhost command
-			if insideVhost {
-				conf.addVhost(*curVhost)
-				curVhost = nil
-				insideVhost = false
+			switch b := blocks[len(blocks)-1]; {
+			case b.upstream != nil:
+				b.upstream.addOption(opName, opValue)
+			case b.srv != nil:
+				// option for the current virtual host or location
+				b.srv.addOption(opName, opValue)
+			}
+			continue
+		}
+		if isBlock {
+			// the start of a block, unknown blocks are kept
+			// so that their closing brackets are matched
+			fields := strings.Fields(string(line[:len(line)-1]))
+			b := &confBlock{}
+			if len(fields) > 0 {
+				b.name = fields[0]
+			}
+			switch b.name {
+			case vhostOption:
+				b.srv = &ServerConf{}
+			case upstreamOption:
+				if len(fields) == 2 {
+					b.upstream = &UpstreamConf{Name: fields[1]}
+				}
+			case locationOption:
+				loc, err := newLocation(fields[1:])
+				if err != nil {
+					return nil, err
+				}
+				b.loc = &loc
+				b.srv = &loc.Server
+				b.parent = conf.defaultServer()
+				if len(blocks) > 0 && blocks[len(blocks)-1].srv != nil {
+					b.parent = blocks[len(blocks)-1].srv
+				}
+			}
+			blocks = append(blocks, b)
+			continue
+		}
+		if line[0] == closingBracket && len(blocks) > 0 {
+			b := blocks[len(blocks)-1]
+			blocks = blocks[:len(blocks)-1]
+			switch {
+			case b.loc != nil:
+				b.parent.Locations = append(b.parent.Locations, *b.loc)
+			case b.upstream != nil:
+				conf.Upstreams = append(conf.Upstreams, *b.upstream)
+			case b.srv != nil:
+				conf.addVhost(*b.srv)
 			}
 		}
 	}
@@ -241,20 +966,686 @@ func buildServerConf(file []byte) (*Conf, error) {
 		log.Println(err)
 		return nil, err
 	}
+	conf.setLimitZones()
+	for i := range conf.Vhosts {
+		conf.Vhosts[i].inherit(conf.DefaultServer)
+	}
+	for _, srv := range conf.servers() {
+		for i := range srv.Locations {
+			srv.Locations[i].Server.inheritLocation(srv, &srv.Locations[i])
+		}
+	}
 	return conf, nil
 }
 
-func parseIncludes(file []byte) ([]byte, error) {
-	// TODO: this should load and expand every single "include"
-	// in the configuration file
-	return file, nil
+// parseIncludes loads and expands every "include" option in the
+// configuration file, the included files can include other files too.
+// It also returns where every line of the expanded file came from
+func parseIncludes(file []byte, filename string) ([]byte, []confLine, error) {
+	return expandIncludes(file, filename, nil)
+}
+
+// confLine is the file and the line number of
+// a line in the expanded configuration file
+type confLine struct {
+	file string
+	num  int
+}
+
+// expandIncludes replaces every include line with the contents of the
+// files that it matches, parents contains the files that are currently
+// being expanded so that include cycles can be detected
+func expandIncludes(file []byte, filename string, parents []string) ([]byte, []confLine, error) {
+	absName, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range parents {
+		if p == absName {
+			return nil, nil, fmt.Errorf("%w: %s includes itself", ErrIncludeCycle, filename)
+		}
+	}
+	parents = append(parents, absName)
+	expanded := make([]byte, 0, len(file))
+	lines := make([]confLine, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	num := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		num++
+		pattern, ok := includePattern(line)
+		if !ok {
+			expanded = append(expanded, line...)
+			expanded = append(expanded, byte('\n'))
+			lines = append(lines, confLine{filename, num})
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			// relative to the file that has the include
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: invalid include %s: %w", filename, num, pattern, err)
+		}
+		if len(matches) == 0 && !hasGlobMeta(pattern) {
+			// a single file that does not exist
+			return nil, nil, fmt.Errorf("%s:%d: included file %s not found", filename, num, pattern)
+		}
+		for _, m := range matches {
+			included, err := openAndStripComments(m)
+			if err != nil {
+				return nil, nil, err
+			}
+			included, includedLines, err := expandIncludes(included, m, parents)
+			if err != nil {
+				return nil, nil, err
+			}
+			expanded = append(expanded, included...)
+			lines = append(lines, includedLines...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return expanded, lines, nil
+}
+
+// includePattern returns the file (or glob pattern)
+// of the line if it's an include option
+func includePattern(line []byte) (string, bool) {
+	ops := bytes.SplitN(line, []byte{byte(equalSign)}, 2)
+	if len(ops) != 2 {
+		return "", false
+	}
+	if string(bytes.TrimSpace(ops[0])) != includeOption {
+		return "", false
+	}
+	return string(bytes.TrimSpace(ops[1])), true
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// SyntaxError is an error found in a line of the configuration
+type SyntaxError struct {
+	File   string
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
 }
 
-func checkForSyntaxErrors(file []byte) error {
-	// TODO: check for syntax errors in the file:
-	// - Symbols that are not recognized
-	// - Options that are unknown
-	// - Opened brackets that are not closed (and viceversa)
+// SyntaxErrors are all of the errors found in the configuration
+type SyntaxErrors []*SyntaxError
+
+func (e SyntaxErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// optionCheck validates the value of an option
+type optionCheck func(value string) error
+
+// the options that are only allowed at the top level
+var globalOptions = map[string]optionCheck{
+	userOption:    checkNotEmpty,
+	groupOption:   checkNotEmpty,
+	workersOption: checkPositiveInt,
+	pidFileOption: checkNotEmpty,
+	daemonOption:  checkOnOff,
+
+	shutdownTimeoutOption:   checkDuration,
+	keepAliveTimeoutOption:  checkDuration,
+	keepAliveRequestsOption: checkPositiveInt,
+
+	headerTimeoutOption:  checkDuration,
+	bodyTimeoutOption:    checkDuration,
+	writeTimeoutOption:   checkDuration,
+	maxRequestLineOption: checkSize,
+	maxHeaderSizeOption:  checkSize,
+	maxHeadersOption:     checkPositiveInt,
+}
+
+// the options allowed at the top level and inside of a vhost
+var serverOptions = map[string]optionCheck{
+	nameOption:      checkNotEmptyList,
+	rootOption:      checkNotEmpty,
+	portOption:      checkPorts,
+	indexOption:     checkNotEmptyList,
+	errorPageOption: checkNotEmpty,
+	errorLogOption:  checkErrorLog,
+	accessLogOption: checkNotEmpty,
+
+	maxBodySizeOption: checkSize,
+	logFormatOption:   checkNotEmpty,
+
+	sslCertificateOption:    checkNotEmpty,
+	sslCertificateKeyOption: checkNotEmpty,
+	tlsMinVersionOption:     checkTLSVersion,
+	tlsCiphersOption:        checkCiphers,
+	httpsRedirectOption:     checkOnOff,
+
+	fastcgiPassOption:    checkFastCGIPass,
+	fastcgiMatchOption:   checkFastCGIMatch,
+	fastcgiTimeoutOption: checkDuration,
+
+	proxyPassOption: checkProxyPass,
+	methodsOption:   checkMethods,
+	rewriteOption:   checkRewrite,
+	returnOption:    checkReturn,
+	etagOption:      checkETag,
+
+	autoindexOption:       checkOnOff,
+	autoindexHiddenOption: checkOnOff,
+
+	authBasicOption:         checkNotEmpty,
+	authBasicUserFileOption: checkNotEmpty,
+
+	compressionOption:        checkOnOff,
+	compressionTypesOption:   checkNotEmptyList,
+	compressionMinSizeOption: checkSize,
+	compressionStaticOption:  checkOnOff,
+
+	limitReqOption:  checkLimitReq,
+	limitConnOption: checkLimitConn,
+}
+
+// the server options that a location can override
+var locationOptions = map[string]bool{
+	rootOption:           true,
+	indexOption:          true,
+	errorPageOption:      true,
+	maxBodySizeOption:    true,
+	fastcgiPassOption:    true,
+	fastcgiMatchOption:   true,
+	fastcgiTimeoutOption: true,
+	proxyPassOption:      true,
+	methodsOption:        true,
+	rewriteOption:        true,
+	returnOption:         true,
+	etagOption:           true,
+
+	autoindexOption:       true,
+	autoindexHiddenOption: true,
+
+	authBasicOption:         true,
+	authBasicUserFileOption: true,
+
+	compressionOption:        true,
+	compressionTypesOption:   true,
+	compressionMinSizeOption: true,
+	compressionStaticOption:  true,
+
+	limitReqOption:  true,
+	limitConnOption: true,
+}
+
+// checkForSyntaxErrors checks every line of the file and reports all of the
+// errors that are found, lines tells the file and line number of each line
+func checkForSyntaxErrors(file []byte, lines []confLine) error {
+	errs := make(SyntaxErrors, 0)
+	addErr := func(i, col int, format string, a ...interface{}) {
+		pos := confLine{"", i + 1}
+		if i < len(lines) {
+			pos = lines[i]
+		}
+		errs = append(errs, &SyntaxError{
+			File:   pos.file,
+			Line:   pos.num,
+			Column: col,
+			Msg:    fmt.Sprintf(format, a...),
+		})
+	}
+	// the blocks that are currently open, unknown blocks are also
+	// tracked so that their closing brackets are not reported
+	type block struct {
+		name string
+		arg  string
+		line int
+		col  int
+		// whether an upstream has any servers
+		servers bool
+		// the auth scope of a vhost or a location
+		scope int
+	}
+	blocks := make([]block, 0)
+	inside := func(name string) bool {
+		for _, b := range blocks {
+			if b.name == name {
+				return true
+			}
+		}
+		return false
+	}
+	// the auth_basic options of the default server (the first one), the
+	// vhosts and the locations, they're checked at the end since the
+	// default server can have them after its blocks
+	type authScope struct {
+		parent   int
+		basic    string
+		line     int
+		col      int
+		userFile bool
+	}
+	scopes := []authScope{{parent: -1}}
+	scope := func() int {
+		for j := len(blocks) - 1; j >= 0; j-- {
+			if blocks[j].scope > 0 {
+				return blocks[j].scope
+			}
+		}
+		return 0
+	}
+	for i, l := range strings.Split(string(file), "\n") {
+		line := strings.TrimSpace(l)
+		if line == "" {
+			continue
+		}
+		col := strings.Index(l, line) + 1
+		if eq := strings.IndexRune(l, equalSign); eq != -1 && line[len(line)-1] != openBracket {
+			opName := strings.TrimSpace(l[:eq])
+			opValue := strings.TrimSpace(l[eq+1:])
+			valueCol := eq + 2 + len(l[eq+1:]) - len(strings.TrimLeft(l[eq+1:], " \t"))
+			if opName == "" {
+				addErr(i, col, "missing option name")
+				continue
+			}
+			var check optionCheck
+			var err error
+			if inside(upstreamOption) {
+				check, err = findUpstreamOptionCheck(opName)
+				if opName == upstreamServerOption {
+					blocks[len(blocks)-1].servers = true
+				}
+			} else if inside(locationOption) {
+				check, err = findLocationOptionCheck(opName)
+			} else {
+				check, err = findOptionCheck(opName, inside(vhostOption))
+			}
+			if err != nil {
+				addErr(i, col, "%s", err)
+				continue
+			}
+			if err := check(opValue); err != nil {
+				addErr(i, valueCol, "invalid value for %s: %s", opName, err)
+			} else if opName == authBasicOption {
+				s := &scopes[scope()]
+				s.basic, s.line, s.col = opValue, i, col
+			} else if opName == authBasicUserFileOption {
+				scopes[scope()].userFile = true
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case line == string(closingBracket):
+			if len(blocks) == 0 {
+				addErr(i, col, "unexpected %c", closingBracket)
+				continue
+			}
+			b := blocks[len(blocks)-1]
+			if b.name == upstreamOption && !b.servers {
+				addErr(b.line, b.col, "%s %s has no servers", upstreamOption, b.arg)
+			}
+			blocks = blocks[:len(blocks)-1]
+		case line[len(line)-1] == openBracket:
+			blockFields := strings.Fields(line[:len(line)-1])
+			name, args := "", ""
+			if len(blockFields) > 0 {
+				name, args = blockFields[0], strings.Join(blockFields[1:], " ")
+			}
+			switch {
+			case name == "":
+				addErr(i, col, "unexpected %c", openBracket)
+			case name == vhostOption && args != "":
+				addErr(i, col+len(vhostOption)+1, "unexpected %s after %s", args, vhostOption)
+			case name == vhostOption && len(blocks) > 0:
+				addErr(i, col, "%s blocks can't be nested", vhostOption)
+			case name == upstreamOption && len(blockFields) != 2:
+				addErr(i, col, "%s needs a single name", upstreamOption)
+			case name == upstreamOption && len(blocks) > 0:
+				addErr(i, col, "%s blocks are only allowed at the top level", upstreamOption)
+			case name == locationOption && (inside(locationOption) || inside(upstreamOption)):
+				addErr(i, col, "%s blocks are only allowed at the top level or inside of a %s", locationOption, vhostOption)
+			case name == locationOption:
+				if _, err := newLocation(blockFields[1:]); err != nil {
+					addErr(i, col, "%s", err)
+				}
+			case name != vhostOption && name != upstreamOption:
+				addErr(i, col, "unknown block %s", name)
+			}
+			// an upstream with errors is not checked for servers
+			b := block{name: name, arg: args, line: i, col: col, servers: name == upstreamOption && len(blockFields) != 2}
+			switch name {
+			case vhostOption:
+				scopes = append(scopes, authScope{parent: 0})
+				b.scope = len(scopes) - 1
+			case locationOption:
+				scopes = append(scopes, authScope{parent: scope()})
+				b.scope = len(scopes) - 1
+			}
+			blocks = append(blocks, b)
+		case fields[0] == vhostOption || fields[0] == upstreamOption || fields[0] == locationOption:
+			addErr(i, col, "%s without an opening %c", fields[0], openBracket)
+		default:
+			addErr(i, col, "unknown directive %s", fields[0])
+		}
+	}
+	// the user file can come from the parent, like every other option
+	for _, s := range scopes {
+		if s.basic == "" || s.basic == "off" {
+			continue
+		}
+		userFile := s.userFile
+		for p := s.parent; !userFile && p >= 0; p = scopes[p].parent {
+			userFile = scopes[p].userFile
+		}
+		if !userFile {
+			addErr(s.line, s.col, "%s is on but there is no %s", authBasicOption, authBasicUserFileOption)
+		}
+	}
+	for _, b := range blocks {
+		addErr(b.line, b.col, "%s is missing a closing %c", b.name, closingBracket)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// findOptionCheck returns the function that validates
+// the option, it fails if the option is unknown
+func findOptionCheck(opName string, insideVhost bool) (optionCheck, error) {
+	if check, ok := serverOptions[opName]; ok {
+		return check, nil
+	}
+	if strings.HasPrefix(opName, errorPageOption+"_") {
+		if err := checkErrorPageCode(strings.TrimPrefix(opName, errorPageOption+"_")); err != nil {
+			return nil, err
+		}
+		return checkNotEmpty, nil
+	}
+	if check, ok := globalOptions[opName]; ok {
+		if insideVhost {
+			return nil, fmt.Errorf("option %s is not allowed inside of a %s", opName, vhostOption)
+		}
+		return check, nil
+	}
+	return nil, fmt.Errorf("unknown option %s", opName)
+}
+
+// findLocationOptionCheck returns the function that validates an
+// option inside of a location, only some server options are allowed
+func findLocationOptionCheck(opName string) (optionCheck, error) {
+	check, err := findOptionCheck(opName, false)
+	if err != nil {
+		return nil, err
+	}
+	name := opName
+	if strings.HasPrefix(name, errorPageOption+"_") {
+		name = errorPageOption
+	}
+	if !locationOptions[name] {
+		return nil, fmt.Errorf("option %s is not allowed inside of a %s", opName, locationOption)
+	}
+	return check, nil
+}
+
+// the options allowed inside of an upstream
+var upstreamOptions = map[string]optionCheck{
+	upstreamServerOption:    checkUpstreamServers,
+	balanceOption:           checkBalance,
+	maxFailsOption:          checkPositiveInt,
+	failTimeoutOption:       checkDuration,
+	upstreamKeepAliveOption: checkPositiveInt,
+}
+
+func findUpstreamOptionCheck(opName string) (optionCheck, error) {
+	if check, ok := upstreamOptions[opName]; ok {
+		return check, nil
+	}
+	return nil, fmt.Errorf("option %s is not allowed inside of an %s", opName, upstreamOption)
+}
+
+func checkNotEmpty(value string) error {
+	if value == "" {
+		return errors.New("value is empty")
+	}
+	return nil
+}
+
+func checkNotEmptyList(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if strings.TrimSpace(v) == "" {
+			return errors.New("the list has an empty value")
+		}
+	}
+	return nil
+}
+
+func checkErrorLog(value string) error {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return errors.New("expected a file and an optional level")
+	}
+	if len(fields) == 2 {
+		if _, ok := logLevels[fields[1]]; !ok {
+			return fmt.Errorf("unknown log level %q", fields[1])
+		}
+	}
+	return nil
+}
+
+func checkPositiveInt(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("%q is not a positive number", value)
+	}
+	return nil
+}
+
+func checkDuration(value string) error {
+	if _, err := parseDuration(value); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseDuration parses a duration like "1m30s", a number
+// without any unit is the amount of seconds
+func parseDuration(value string) (time.Duration, error) {
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%q is not a valid duration", value)
+	}
+	return d, nil
+}
+
+func checkSize(value string) error {
+	if _, err := parseSize(value); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseSize parses a size in bytes, it can
+// have a k, m or g suffix (like "512k" or "1m")
+func parseSize(value string) (int64, error) {
+	unit := int64(1)
+	num := strings.ToLower(value)
+	switch {
+	case strings.HasSuffix(num, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(num, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(num, "g"):
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a valid size", value)
+	}
+	return n * unit, nil
+}
+
+func checkPorts(value string) error {
+	for _, p := range strings.Split(value, ",") {
+		fields := strings.Fields(p)
+		if len(fields) == 0 {
+			return errors.New("the list has an empty value")
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil || n <= 0 || n > 65535 {
+			return fmt.Errorf("%q is not a valid port", fields[0])
+		}
+		if len(fields) > 2 || (len(fields) == 2 && fields[1] != tlsPortFlag) {
+			return fmt.Errorf("unexpected %q after port %d", strings.Join(fields[1:], " "), n)
+		}
+	}
+	return nil
+}
+
+func checkOnOff(value string) error {
+	if value != "on" && value != "off" {
+		return fmt.Errorf("%q is not on or off", value)
+	}
+	return nil
+}
+
+func checkFastCGIPass(value string) error {
+	if strings.HasPrefix(value, "unix:") {
+		if strings.TrimPrefix(value, "unix:") == "" {
+			return errors.New("the socket is empty")
+		}
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(value); err != nil || port == "" {
+		return fmt.Errorf("%q is not host:port or unix:/path", value)
+	}
+	return nil
+}
+
+func checkFastCGIMatch(value string) error {
+	if err := checkNotEmptyList(value); err != nil {
+		return err
+	}
+	for _, m := range splitList(value) {
+		if !strings.HasPrefix(m, ".") && !strings.HasPrefix(m, "/") {
+			return fmt.Errorf("%q is not an extension (.php) or a path (/cgi-bin/)", m)
+		}
+	}
+	return nil
+}
+
+func checkUpstreamServers(value string) error {
+	if err := checkNotEmptyList(value); err != nil {
+		return err
+	}
+	for _, srv := range splitList(value) {
+		if _, port, err := net.SplitHostPort(srv); err != nil || port == "" {
+			return fmt.Errorf("%q is not host:port", srv)
+		}
+	}
+	return nil
+}
+
+func checkBalance(value string) error {
+	switch value {
+	case balanceRoundRobin, balanceLeastConn, balanceIPHash:
+		return nil
+	}
+	return fmt.Errorf("unknown balance method %q", value)
+}
+
+func checkMethods(value string) error {
+	if err := checkNotEmptyList(value); err != nil {
+		return err
+	}
+	for _, m := range splitList(value) {
+		if err := (&Request{Method: m}).validateMethod(); err != nil {
+			return fmt.Errorf("unknown method %q", m)
+		}
+	}
+	return nil
+}
+
+func checkProxyPass(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("%q is not an http url", value)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q can't have a query", value)
+	}
+	return nil
+}
+
+func checkRewrite(value string) error {
+	_, err := parseRewrite(value)
+	return err
+}
+
+func checkReturn(value string) error {
+	if err := checkNotEmpty(value); err != nil {
+		return err
+	}
+	_, err := parseReturn(value)
+	return err
+}
+
+func checkETag(value string) error {
+	switch value {
+	case etagStrong, etagWeak, etagOff:
+		return nil
+	}
+	return fmt.Errorf("expected %s, %s or %s", etagStrong, etagWeak, etagOff)
+}
+
+func checkLimitReq(value string) error {
+	_, _, err := parseLimitReq(value)
+	return err
+}
+
+func checkLimitConn(value string) error {
+	_, err := parseLimitConn(value)
+	return err
+}
+
+func checkTLSVersion(value string) error {
+	if _, ok := tlsVersions[value]; !ok {
+		return fmt.Errorf("unknown tls version %q", value)
+	}
+	return nil
+}
+
+func checkCiphers(value string) error {
+	for _, c := range strings.Split(value, ",") {
+		if _, ok := cipherID(strings.TrimSpace(c)); !ok {
+			return fmt.Errorf("unknown cipher suite %q", strings.TrimSpace(c))
+		}
+	}
+	return nil
+}
+
+func checkErrorPageCode(code string) error {
+	n, err := strconv.Atoi(code)
+	if err != nil || n < StatusBadRequest || n > 599 {
+		return fmt.Errorf("invalid status code %q for %s", code, errorPageOption)
+	}
 	return nil
 }
 
@@ -271,14 +1662,14 @@ scan:
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		foundComment := false
-		for i, b := range line {
+		for _, b := range line {
 			if rune(b) == commentSign {
 				foundComment = true
 			}
 			if foundComment {
-				if i != 0 {
-					file = append(file, byte('\n'))
-				}
+				// the line is always kept, even if it's empty,
+				// so that the line numbers of the file don't change
+				file = append(file, byte('\n'))
 				continue scan
 			} else {
 				file = append(file, b)
@@ -2,9 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCommentsAreStripped(t *testing.T) {
@@ -32,15 +36,99 @@ func TestCommentsAreStripped(t *testing.T) {
 }
 
 func TestIncludedFilesAreParsed(t *testing.T) {
-	t.Skipf("todo")
+	conf, err := Load("testdata/include/httpd.conf")
+	if err != nil {
+		t.Fatalf("error loading conf file %s", err)
+	}
+	if conf.User != "www-data" || conf.DefaultServer.Root != "/var/www/localhost" {
+		t.Errorf("the options of common.conf were not included")
+	}
+	want := []struct {
+		name string
+		root string
+		port int
+	}{
+		{"included.com", "/var/www/included.com", 8081},
+		{"a.com", "/var/www/a.com", 8081},
+		{"b.com", "/var/www/b.com", 8082},
+	}
+	if len(conf.Vhosts) != len(want) {
+		t.Fatalf("expected %d vhosts but got %d", len(want), len(conf.Vhosts))
+	}
+	for i, w := range want {
+		vhost := conf.Vhosts[i]
+		if !reflect.DeepEqual(vhost.Names, []string{w.name}) || vhost.Root != w.root || !reflect.DeepEqual(vhost.Ports, []int{w.port}) {
+			t.Errorf("vhost #%d is not correct, got %v %s %v", i+1, vhost.Names, vhost.Root, vhost.Ports)
+		}
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	if _, err := Load("testdata/include/cycle/httpd.conf"); !errors.Is(err, ErrIncludeCycle) {
+		t.Errorf("expected an include cycle error but got %v", err)
+	}
+	if _, err := Load("testdata/include/missing.conf"); err == nil {
+		t.Errorf("expected an error for a missing included file")
+	}
 }
 
 func TestNoSyntaxErrorsAreFound(t *testing.T) {
-	t.Skipf("todo")
+	confFiles := []string{
+		"testdata/conf1.txt",
+		"testdata/conf2.txt",
+		"testdata/conf3.txt",
+		"testdata/httpd.conf",
+		"testdata/test1.conf",
+		"testdata/include/httpd.conf",
+	}
+	for _, confFile := range confFiles {
+		file, err := openAndStripComments(confFile)
+		if err != nil {
+			t.Fatalf("error reading conf file %s", err)
+		}
+		file, lines, err := parseIncludes(file, confFile)
+		if err != nil {
+			t.Fatalf("error parsing includes %s", err)
+		}
+		if err := checkForSyntaxErrors(file, lines); err != nil {
+			t.Errorf("syntax errors found in %s:\n%s", confFile, err)
+		}
+	}
 }
 
 func TestSyntaxErrorsAreFound(t *testing.T) {
-	t.Skipf("todo")
+	confFile := "testdata/syntax_errors.conf"
+	file, err := openAndStripComments(confFile)
+	if err != nil {
+		t.Fatalf("error reading conf file %s", err)
+	}
+	file, lines, err := parseIncludes(file, confFile)
+	if err != nil {
+		t.Fatalf("error parsing includes %s", err)
+	}
+	want, err := ioutil.ReadFile("testdata/syntax_errors_want.txt")
+	if err != nil {
+		t.Fatalf("error reading syntax_errors_want file %s", err)
+	}
+	err = checkForSyntaxErrors(file, lines)
+	if err == nil {
+		t.Fatalf("no syntax errors were found")
+	}
+	if err.Error() != strings.TrimSpace(string(want)) {
+		t.Errorf("the syntax errors are not correct, got:\n%s\nbut want:\n%s", err, want)
+	}
+}
+
+func TestSyntaxErrorsInIncludedFiles(t *testing.T) {
+	_, err := Load("testdata/include/bad.conf")
+	var errs SyntaxErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected syntax errors but got %v", err)
+	}
+	want := "testdata/include/sites/bad.inc:2:5: unknown option rot"
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("the syntax errors are not correct, got %s but want %s", errs, want)
+	}
 }
 
 func TestServerConfIsBuilt(t *testing.T) {
@@ -55,7 +143,7 @@ func TestServerConfIsBuilt(t *testing.T) {
 			IndexPages: []string{"index.html", "index.htm"},
 			ErrorPages: []ErrorPage{
 				{
-					Code: 400,
+					Code: 0,
 					Page: "error.html",
 				},
 				{
@@ -74,7 +162,7 @@ func TestServerConfIsBuilt(t *testing.T) {
 				IndexPages: []string{"index.html"},
 				ErrorPages: []ErrorPage{
 					{
-						Code: 400,
+						Code: 0,
 						Page: "error.html",
 					},
 				},
@@ -88,7 +176,7 @@ func TestServerConfIsBuilt(t *testing.T) {
 				IndexPages: []string{"index.html"},
 				ErrorPages: []ErrorPage{
 					{
-						Code: 400,
+						Code: 0,
 						Page: "error.html",
 					},
 				},
@@ -102,7 +190,7 @@ func TestServerConfIsBuilt(t *testing.T) {
 				IndexPages: []string{"index.html"},
 				ErrorPages: []ErrorPage{
 					{
-						Code: 400,
+						Code: 0,
 						Page: "error.html",
 					},
 				},
@@ -132,3 +220,168 @@ func TestServerConfIsBuilt(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorPageLookup(t *testing.T) {
+	srv := &ServerConf{}
+	srv.addOption("error_page_404", "404.html")
+	srv.addOption("error_page", "error.html")
+	srv.addOption("error_page_500", "500.html")
+	tests := []struct {
+		code int
+		want string
+	}{
+		{404, "404.html"},
+		{500, "500.html"},
+		{403, "error.html"},
+		{502, "error.html"},
+	}
+	for _, test := range tests {
+		if page := srv.errorPage(test.code); page != test.want {
+			t.Errorf("errorPage(%d) returned %s but want %s", test.code, page, test.want)
+		}
+	}
+	if page := (&ServerConf{}).errorPage(404); page != "" {
+		t.Errorf("errorPage(404) should be empty without error pages, got %s", page)
+	}
+	// the page of a code is only for that code
+	srv = &ServerConf{}
+	srv.addOption("error_page_400", "bad.html")
+	if page := srv.errorPage(400); page != "bad.html" {
+		t.Errorf("errorPage(400) returned %s but want bad.html", page)
+	}
+	if page := srv.errorPage(404); page != "" {
+		t.Errorf("errorPage(404) should be empty without error_page, got %s", page)
+	}
+}
+
+func TestErrorLogLevelOption(t *testing.T) {
+	srv := &ServerConf{}
+	srv.addOption("error_log", "/var/log/httpd/error.log warn")
+	if srv.ErrorLog != "/var/log/httpd/error.log" || srv.ErrorLogLevel != "warn" {
+		t.Errorf("error_log was not parsed, got %s and %s", srv.ErrorLog, srv.ErrorLogLevel)
+	}
+	if srv.errorLogLevel() != LogWarn {
+		t.Errorf("the level of the error log should be warn")
+	}
+	if err := checkErrorLog("/var/log/httpd/error.log loud"); err == nil {
+		t.Errorf("an unknown level should not be valid")
+	}
+}
+
+func TestTLSPortsOption(t *testing.T) {
+	srv := &ServerConf{}
+	srv.addOption("port", "80, 443 tls, 8443 tls")
+	if !reflect.DeepEqual(srv.Ports, []int{80, 443, 8443}) {
+		t.Errorf("the ports were not parsed, got %v", srv.Ports)
+	}
+	if !reflect.DeepEqual(srv.TLSPorts, []int{443, 8443}) {
+		t.Errorf("the tls ports were not parsed, got %v", srv.TLSPorts)
+	}
+	if srv.usesTLS(80) || !srv.usesTLS(443) {
+		t.Errorf("only the ports with the tls flag should use tls")
+	}
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"80, 443 tls", true},
+		{"443 tls", true},
+		{"443 ssl", false},
+		{"443 tls tls", false},
+		{"80,", false},
+	}
+	for _, test := range tests {
+		if err := checkPorts(test.value); (err == nil) != test.valid {
+			t.Errorf("checkPorts(%q) returned %v", test.value, err)
+		}
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	if err := checkTLSVersion("1.3"); err != nil {
+		t.Errorf("1.3 should be a valid tls version: %s", err)
+	}
+	if err := checkTLSVersion("3"); err == nil {
+		t.Errorf("3 should not be a valid tls version")
+	}
+	if err := checkCiphers("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"); err != nil {
+		t.Errorf("the cipher suites should be valid: %s", err)
+	}
+	if err := checkCiphers("TLS_NOT_A_CIPHER"); err == nil {
+		t.Errorf("an unknown cipher suite should not be valid")
+	}
+	srv := &ServerConf{}
+	if srv.tlsMinVersion() != tls.VersionTLS12 {
+		t.Errorf("the minimum tls version should be 1.2 by default")
+	}
+	vhost := &ServerConf{SSLCertificate: "vhost.pem"}
+	vhost.inherit(&ServerConf{SSLCertificate: "default.pem", SSLCertificateKey: "default.key", TLSMinVersion: "1.3"})
+	if vhost.SSLCertificateKey != "" {
+		t.Errorf("the key of the default server should not be used with another certificate")
+	}
+	if vhost.tlsMinVersion() != tls.VersionTLS13 {
+		t.Errorf("the minimum tls version should be inherited")
+	}
+}
+
+func TestFastCGIOptions(t *testing.T) {
+	tests := []struct {
+		check optionCheck
+		value string
+		valid bool
+	}{
+		{checkFastCGIPass, "127.0.0.1:9000", true},
+		{checkFastCGIPass, "unix:/run/php/php-fpm.sock", true},
+		{checkFastCGIPass, "unix:", false},
+		{checkFastCGIPass, "127.0.0.1", false},
+		{checkFastCGIMatch, ".php, /cgi-bin/", true},
+		{checkFastCGIMatch, "php", false},
+		{checkFastCGIMatch, ".php,", false},
+	}
+	for _, test := range tests {
+		if err := test.check(test.value); (err == nil) != test.valid {
+			t.Errorf("the check of %q returned %v", test.value, err)
+		}
+	}
+}
+
+func TestUpstreamIsBuilt(t *testing.T) {
+	file := []byte(`root = /var/www
+upstream backend {
+    server = 10.0.0.1:8080, 10.0.0.2:8080
+    server = 10.0.0.3:8080
+    balance = least_conn
+    max_fails = 3
+    fail_timeout = 30s
+}
+vhost {
+    name = api.com
+    proxy_pass = http://backend
+}
+`)
+	conf, err := buildServerConf(file)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	want := []UpstreamConf{
+		{
+			Name:        "backend",
+			Servers:     []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"},
+			Balance:     balanceLeastConn,
+			MaxFails:    3,
+			FailTimeout: 30 * time.Second,
+		},
+	}
+	if !reflect.DeepEqual(conf.Upstreams, want) {
+		t.Errorf("the upstreams are not correct, got %+v", conf.Upstreams)
+	}
+	if len(conf.Vhosts) != 1 || conf.Vhosts[0].ProxyPass != "http://backend" {
+		t.Errorf("the vhost should have the proxy_pass option, got %+v", conf.Vhosts)
+	}
+	if conf.Upstreams[0].keepAlive() != defaultUpstreamKeepAlive {
+		t.Errorf("the idle connections should have a default")
+	}
+	if err := checkProxyPass("https://backend"); err == nil {
+		t.Errorf("only http upstreams should be valid")
+	}
+}
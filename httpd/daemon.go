@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the pid file of the server and the signals sent to it with -s, and
+// running in the background as a daemon. Go can't fork the process
+// so the daemon is the same binary started again in its own session
+
+// set in the environment of the process that runs in the background
+const daemonEnv = "HTTPD_DAEMON"
+
+// the signals that can be sent with -s
+var controlSignals = map[string]syscall.Signal{
+	"stop":    syscall.SIGTERM,
+	"reload":  syscall.SIGHUP,
+	"reopen":  syscall.SIGUSR1,
+	"upgrade": syscall.SIGUSR2,
+}
+
+// writePidFile writes the pid to the file, it's replaced if it exists
+func writePidFile(name string, pid int) error {
+	return os.WriteFile(name, []byte(strconv.Itoa(pid)+"\n"), 0644)
+}
+
+// readPidFile returns the pid written to the file
+func readPidFile(name string) (int, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid in %s", name)
+	}
+	return pid, nil
+}
+
+// removePidFile removes the file if it still has the pid, it could
+// have been replaced by the pid of another server in the meantime
+func removePidFile(name string, pid int) {
+	if p, err := readPidFile(name); err == nil && p == pid {
+		os.Remove(name)
+	}
+}
+
+// sendSignal sends the signal to the server with the pid
+// in the pid file of the configuration
+func sendSignal(conf *Conf, name string) error {
+	sig, ok := controlSignals[name]
+	if !ok {
+		return fmt.Errorf("unknown signal %q, it should be stop, reload, reopen or upgrade", name)
+	}
+	pid, err := readPidFile(conf.pidFile())
+	if err != nil {
+		return err
+	}
+	if err := syscall.Kill(pid, sig); err != nil {
+		if errors.Is(err, syscall.ESRCH) {
+			return fmt.Errorf("the server is not running, there is no process %d", pid)
+		}
+		return fmt.Errorf("error sending %s to %d: %w", name, pid, err)
+	}
+	return nil
+}
+
+func isDaemon() bool {
+	return os.Getenv(daemonEnv) != ""
+}
+
+// daemonize starts the server again in the background, in a new session
+// without a terminal, the process that calls it should exit
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd.Start()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "httpd.pid")
+	if err := writePidFile(name, 1234); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	pid, err := readPidFile(name)
+	if err != nil || pid != 1234 {
+		t.Errorf("readPidFile() = %d, %v, want 1234\n", pid, err)
+	}
+	// the file of another server is kept
+	removePidFile(name, 4321)
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("the pid file of another process should not be removed\n")
+	}
+	removePidFile(name, 1234)
+	if _, err := os.Stat(name); err == nil {
+		t.Errorf("the pid file should be removed\n")
+	}
+	for _, content := range []string{"", "abc\n", "-1\n"} {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		if _, err := readPidFile(name); err == nil {
+			t.Errorf("readPidFile() of %q should fail\n", content)
+		}
+	}
+}
+
+func TestSendSignal(t *testing.T) {
+	conf := &Conf{PidFile: filepath.Join(t.TempDir(), "httpd.pid")}
+	if err := sendSignal(conf, "restart"); err == nil {
+		t.Errorf("sending an unknown signal should fail\n")
+	}
+	if err := sendSignal(conf, "stop"); err == nil {
+		t.Errorf("sending a signal without a pid file should fail\n")
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI gateway, the requests for scripts are sent to a backend
+// (like PHP-FPM) and whatever it writes to its stdout is sent back
+
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder  = 1
+	fcgiRequestID  = 1
+	fcgiHeaderLen  = 8
+	fcgiMaxContent = 65535
+
+	fcgiDialTimeout = 10 * time.Second
+)
+
+var ErrInvalidFastCGIRecord = errors.New("invalid fastcgi record")
+
+// fastcgiScript returns the script (as a path under the root) that handles
+// the request and the path info that follows it, ok is false when the
+// request is not for the backend. A match that starts with a "." is the
+// extension of the scripts and one that starts with a "/" is a path prefix,
+// every request is for the backend when there are no matches (like in a
+// location that only has scripts)
+func fastcgiScript(req *Request, srv *ServerConf) (script string, pathInfo string, ok bool) {
+	p := path.Clean("/" + req.Path())
+	if len(srv.FastCGIMatch) == 0 {
+		if name, err := resolveFile(req.Uri, srv); err == nil {
+			if rel, err := filepath.Rel(srv.Root, name); err == nil {
+				return "/" + filepath.ToSlash(rel), "", true
+			}
+		}
+		return p, "", true
+	}
+	for _, m := range srv.FastCGIMatch {
+		switch {
+		case strings.HasPrefix(m, "."):
+			// the script can be followed by the path info (/index.php/users)
+			if i := strings.Index(p+"/", m+"/"); i != -1 {
+				return p[:i+len(m)], p[i+len(m):], true
+			}
+		case strings.HasPrefix(p+"/", strings.TrimSuffix(m, "/")+"/"):
+			return p, "", true
+		}
+	}
+	// the index page of a directory can be a script too
+	name, err := resolveFile(req.Uri, srv)
+	if err != nil {
+		return "", "", false
+	}
+	for _, m := range srv.FastCGIMatch {
+		if strings.HasPrefix(m, ".") && strings.HasSuffix(name, m) {
+			rel, err := filepath.Rel(srv.Root, name)
+			if err != nil {
+				return "", "", false
+			}
+			return "/" + filepath.ToSlash(rel), "", true
+		}
+	}
+	return "", "", false
+}
+
+// bufferBody reads a chunked body into memory, the
+// backend needs to know its length before it's sent
+func bufferBody(req *Request) error {
+	if req.ContentLength >= 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, req.Body); err != nil {
+		return err
+	}
+	req.Body = &buf
+	req.ContentLength = int64(buf.Len())
+	return nil
+}
+
+// fastcgiParams returns the CGI variables of the request
+func fastcgiParams(conn net.Conn, req *Request, srv *ServerConf, port int, script, pathInfo string) map[string]string {
+	host, _ := req.Host()
+	if host == "" && len(srv.Names) > 0 {
+		host = srv.Names[0]
+	}
+	query, _ := requestVar(req, "query_string")
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "httpd/" + Version,
+		"SERVER_PROTOCOL":   req.Proto(),
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       strconv.Itoa(port),
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.RequestURI(),
+		"DOCUMENT_URI":      req.Path(),
+		"DOCUMENT_ROOT":     srv.Root,
+		"SCRIPT_NAME":       script,
+		"SCRIPT_FILENAME":   filepath.Join(srv.Root, filepath.FromSlash(script)),
+		"PATH_INFO":         pathInfo,
+		"QUERY_STRING":      query,
+		"CONTENT_TYPE":      req.Headers.Get("Content-Type"),
+		"CONTENT_LENGTH":    strconv.FormatInt(req.ContentLength, 10),
+		// php refuses to run scripts without it
+		"REDIRECT_STATUS": "200",
+	}
+	if req.ContentLength == 0 {
+		params["CONTENT_LENGTH"] = ""
+	}
+	if addr, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		params["REMOTE_ADDR"] = addr
+		params["REMOTE_PORT"] = p
+	}
+	if conn != nil {
+		if addr, _, err := net.SplitHostPort(conn.LocalAddr().String()); err == nil {
+			params["SERVER_ADDR"] = addr
+		}
+	}
+	if req.remoteUser != "" {
+		params["REMOTE_USER"] = req.remoteUser
+		params["AUTH_TYPE"] = "Basic"
+	}
+	if req.TLS {
+		params["HTTPS"] = "on"
+	}
+	for k, v := range req.Headers {
+		switch k {
+		case "Content-Type", "Content-Length", "Proxy":
+			// the Proxy header would set HTTP_PROXY for the script (httpoxy)
+			continue
+		}
+		name := "HTTP_" + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		params[name] = strings.Join(v, ", ")
+	}
+	return params
+}
+
+// fastcgiResponse sends the request to the backend of the server and returns
+// a response with its output, the body of the request is streamed to the
+// backend while its output is read
+func (s *Server) fastcgiResponse(conn net.Conn, req *Request, srv *ServerConf, port int, script, pathInfo string) (*Response, error) {
+	network, addr := fastcgiAddr(srv.FastCGIPass)
+	c, err := net.DialTimeout(network, addr, fcgiDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// a backend that hangs can't keep the client waiting forever
+	bc := timeoutConn{c, srv.fastcgiTimeout()}
+	fc := &fcgiConn{
+		conn: bc,
+		r:    bufio.NewReader(bc),
+		stderr: func(msg string) {
+			s.logs.Errorf(srv, LogError, "fastcgi %s: %s", script, msg)
+		},
+	}
+	if err := fc.begin(fastcgiParams(conn, req, srv, port, script, pathInfo)); err != nil {
+		bc.Close()
+		return nil, err
+	}
+	// the stdin goroutine can't be the one that sends "100 Continue",
+	// the response could be written to the client at the same time
+	if req.expect != nil {
+		if err := req.expect.sendContinue(); err != nil {
+			bc.Close()
+			return nil, err
+		}
+	}
+	stdinDone := make(chan struct{})
+	go func() {
+		defer close(stdinDone)
+		if err := fc.writeStream(fcgiStdin, req.Body); err != nil {
+			// the backend can't finish without the rest of the body
+			bc.Close()
+		}
+	}()
+	body := &fcgiBody{fc: fc, stdinDone: stdinDone}
+	res, err := readCGIResponse(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return res, nil
+}
+
+// fastcgiAddr returns the network and the address of the backend,
+// unix sockets are written as "unix:/run/php-fpm.sock"
+func fastcgiAddr(pass string) (string, string) {
+	if strings.HasPrefix(pass, "unix:") {
+		return "unix", strings.TrimPrefix(pass, "unix:")
+	}
+	return "tcp", pass
+}
+
+// readCGIResponse parses the headers written by the script, the status code
+// comes from the Status header, or it's a redirect when there's a Location
+func readCGIResponse(body *fcgiBody) (*Response, error) {
+	br := bufio.NewReader(body)
+	headers, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("invalid headers from the backend: %w", err)
+	}
+	code := StatusOk
+	if status := headers.Get("Status"); status != "" {
+		code, err = strconv.Atoi(strings.Fields(status + " ")[0])
+		if err != nil || code < 100 || code > 999 {
+			return nil, fmt.Errorf("invalid status %q from the backend", status)
+		}
+		headers.Del("Status")
+	} else if headers.Get("Location") != "" {
+		code = StatusFound
+	}
+	length := int64(-1)
+	if cl := headers.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			length = n
+		}
+	}
+	res := NewResponse(code, headers, struct {
+		io.Reader
+		io.Closer
+	}{br, body}, length)
+	if msg, err := GetStatusCodeMessage(code); err != nil || msg == "" {
+		res.Message = "Unknown"
+	}
+	return res, nil
+}
+
+// fcgiConn is a connection to the backend that is used for a single request
+type fcgiConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	mu     sync.Mutex // records can be written by more than one goroutine
+	stderr func(msg string)
+}
+
+// begin starts the request and sends its parameters
+func (c *fcgiConn) begin(params map[string]string) error {
+	// the responder role without keeping the connection open
+	if err := c.writeRecord(fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for k, v := range params {
+		writeParamLength(&buf, len(k))
+		writeParamLength(&buf, len(v))
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return c.writeStream(fcgiParams, &buf)
+}
+
+// writeParamLength writes the length of a name or a value, it takes
+// a single byte when it's short and four bytes otherwise
+func writeParamLength(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n)|1<<31)
+	buf.Write(b[:])
+}
+
+// writeStream sends everything read from r as records of the type,
+// the stream is ended with an empty record
+func (c *fcgiConn) writeStream(typ byte, r io.Reader) error {
+	buf := make([]byte, fcgiMaxContent)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := c.writeRecord(typ, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return c.writeRecord(typ, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *fcgiConn) writeRecord(typ byte, content []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	padding := -len(content) & 7
+	rec := make([]byte, fcgiHeaderLen, fcgiHeaderLen+len(content)+padding)
+	rec[0] = fcgiVersion
+	rec[1] = typ
+	binary.BigEndian.PutUint16(rec[2:], fcgiRequestID)
+	binary.BigEndian.PutUint16(rec[4:], uint16(len(content)))
+	rec[6] = byte(padding)
+	rec = append(rec, content...)
+	rec = append(rec, make([]byte, padding)...)
+	_, err := c.conn.Write(rec)
+	return err
+}
+
+// readRecord reads the next record sent by the backend
+func (c *fcgiConn) readRecord() (byte, []byte, error) {
+	var h [fcgiHeaderLen]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	if h[0] != fcgiVersion {
+		return 0, nil, ErrInvalidFastCGIRecord
+	}
+	n := int(binary.BigEndian.Uint16(h[4:]))
+	content := make([]byte, n+int(h[6]))
+	if _, err := io.ReadFull(c.r, content); err != nil {
+		return 0, nil, err
+	}
+	return h[1], content[:n], nil
+}
+
+// fcgiBody reads the stdout of the backend, the messages on its
+// stderr are logged and the end of the request ends the body
+type fcgiBody struct {
+	fc        *fcgiConn
+	stdinDone chan struct{}
+	buf       []byte
+	err       error
+	closeOnce sync.Once
+}
+
+func (b *fcgiBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		typ, content, err := b.fc.readRecord()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			b.err = err
+			continue
+		}
+		switch typ {
+		case fcgiStdout:
+			b.buf = content
+		case fcgiStderr:
+			if msg := strings.TrimSpace(string(content)); msg != "" {
+				b.fc.stderr(msg)
+			}
+		case fcgiEndRequest:
+			b.err = io.EOF
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Close closes the connection to the backend and waits until
+// the body of the request is not being read anymore
+func (b *fcgiBody) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		err = b.fc.conn.Close()
+		<-b.stdinDone
+	})
+	return err
+}
@@ -1,3 +1,5 @@
 module github.com/jonathantorres/progs/httpd
 
 go 1.19
+
+require golang.org/x/crypto v0.14.0
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits of the requests of every client, by the address that they come
+// from. limit_req allows a number of requests per second (with a burst of
+// requests on top of it) and limit_conn a number of open connections, they're
+// counted from the moment that they're accepted until they're closed
+
+// how often the buckets of the clients that are not sending requests anymore
+// are removed
+const limitSweepInterval = time.Minute
+
+// the Retry-After of the clients that have too many connections
+const limitConnRetryAfter = time.Second
+
+// limitKey is the limit of requests of a server (or of a location) for a client
+type limitKey struct {
+	zone string
+	addr string
+}
+
+// bucket has the requests that a client can send right away, it's
+// refilled at the rate of the limit up to the size of the burst
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	size   float64
+}
+
+type limits struct {
+	mu      sync.Mutex
+	buckets map[limitKey]*bucket
+	// the open connections of every client
+	conns     map[string]int
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newLimits() *limits {
+	return &limits{
+		buckets: make(map[limitKey]*bucket),
+		conns:   make(map[string]int),
+		now:     time.Now,
+	}
+}
+
+// acquire checks the limit of requests of the server for the client, it
+// returns how long the client should wait when the request is rejected
+func (l *limits) acquire(srv *ServerConf, remoteAddr string) (retryAfter time.Duration, ok bool) {
+	if srv.LimitRate <= 0 {
+		return 0, true
+	}
+	addr := clientAddr(remoteAddr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.take(srv, limitKey{srv.limitReqZone, addr})
+}
+
+// tooManyConns reports whether the client has more connections open
+// than the server allows, the connection of the request is one of them
+func (l *limits) tooManyConns(srv *ServerConf, remoteAddr string) bool {
+	if srv.LimitConn <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[clientAddr(remoteAddr)] > srv.LimitConn
+}
+
+// openConn counts a new connection of the client, it's rejected when the
+// client already has max of them (0 is no limit). It returns a function
+// that must be called once the connection is closed
+func (l *limits) openConn(remoteAddr string, max int) (release func(), ok bool) {
+	addr := clientAddr(remoteAddr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if max > 0 && l.conns[addr] >= max {
+		return nil, false
+	}
+	l.conns[addr]++
+	release = func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.conns[addr]--; l.conns[addr] <= 0 {
+			delete(l.conns, addr)
+		}
+	}
+	return release, true
+}
+
+// connLimit returns how many connections a client can have open on the
+// port before the server knows which server (or location) the requests are
+// for, it's the largest limit_conn of them or 0 when one of them has none
+func connLimit(conf *Conf, port int) int {
+	servers := []*ServerConf{conf.DefaultServer}
+	for _, srv := range conf.servers() {
+		if srv != conf.DefaultServer && srv.listensOn(port) {
+			servers = append(servers, srv)
+		}
+	}
+	max := 0
+	for _, srv := range servers {
+		confs := []*ServerConf{srv}
+		for i := range srv.Locations {
+			confs = append(confs, &srv.Locations[i].Server)
+		}
+		for _, s := range confs {
+			if s.LimitConn <= 0 {
+				return 0
+			}
+			if s.LimitConn > max {
+				max = s.LimitConn
+			}
+		}
+	}
+	return max
+}
+
+// clientAddr returns the address of the client without its port
+func clientAddr(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// take takes a request from the bucket of the client, or returns how
+// long it takes to have one when it's empty
+func (l *limits) take(srv *ServerConf, key limitKey) (time.Duration, bool) {
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(srv.LimitBurst + 1), last: now}
+		l.buckets[key] = b
+	}
+	// the limit can change with a reload
+	b.rate, b.size = srv.LimitRate, float64(srv.LimitBurst+1)
+	b.tokens = math.Min(b.size, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / b.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep removes the buckets that are full again, it's
+// the same as if the client never sent a request
+func (l *limits) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.size {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// tooManyRequestsResponse is the response of a request that went over a limit
+func tooManyRequestsResponse(srv *ServerConf, retryAfter time.Duration) *Response {
+	res := errorResponse(srv, StatusTooManyRequests)
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	res.Headers.Set("Retry-After", strconv.Itoa(secs))
+	return res
+}
+
+// parseLimitReq parses a rate like "10r/s" or "60r/m"
+// followed by the optional size of the burst, like "burst=5"
+func parseLimitReq(value string) (float64, int, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, errors.New("expected a rate and an optional burst")
+	}
+	if fields[0] == "off" && len(fields) == 1 {
+		return -1, 0, nil
+	}
+	num, unit, ok := strings.Cut(fields[0], "r/")
+	n, err := strconv.Atoi(num)
+	if !ok || err != nil || n <= 0 || (unit != "s" && unit != "m") {
+		return 0, 0, fmt.Errorf("%q is not a rate like 10r/s or 60r/m", fields[0])
+	}
+	rate := float64(n)
+	if unit == "m" {
+		rate /= 60
+	}
+	burst := 0
+	if len(fields) == 2 {
+		b := strings.TrimPrefix(fields[1], "burst=")
+		if burst, err = strconv.Atoi(b); b == fields[1] || err != nil || burst < 0 {
+			return 0, 0, fmt.Errorf("%q is not a burst like burst=5", fields[1])
+		}
+	}
+	return rate, burst, nil
+}
+
+// parseLimitConn parses the maximum number of connections, or "off"
+func parseLimitConn(value string) (int, error) {
+	if value == "off" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive number", value)
+	}
+	return n, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitReq(t *testing.T) {
+	l := newLimits()
+	now := time.Date(2022, time.March, 10, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	srv := &ServerConf{LimitRate: 2, LimitBurst: 1, limitReqZone: "default"}
+	tests := []struct {
+		// how long after the previous request it's sent
+		after time.Duration
+		addr  string
+		ok    bool
+	}{
+		{0, "10.0.0.1:5000", true},
+		{0, "10.0.0.1:5001", true},
+		{0, "10.0.0.1:5002", false},
+		// every client has its own bucket
+		{0, "10.0.0.2:5000", true},
+		{500 * time.Millisecond, "10.0.0.1:5000", true},
+		{0, "10.0.0.1:5000", false},
+		{time.Second, "10.0.0.1:5000", true},
+		{0, "10.0.0.1:5000", true},
+		{0, "10.0.0.1:5000", false},
+	}
+	for i, test := range tests {
+		now = now.Add(test.after)
+		retryAfter, ok := l.acquire(srv, test.addr)
+		if ok != test.ok {
+			t.Errorf("request #%d from %s returned %t but want %t", i+1, test.addr, ok, test.ok)
+		}
+		if !ok && (retryAfter <= 0 || retryAfter > 500*time.Millisecond) {
+			t.Errorf("request #%d should wait for the next request, got %s", i+1, retryAfter)
+		}
+	}
+	// the buckets of a zone are not shared with another one
+	other := &ServerConf{LimitRate: 2, limitReqZone: "other"}
+	if _, ok := l.acquire(other, "10.0.0.1:5000"); !ok {
+		t.Errorf("the client should have its own limit in another zone")
+	}
+}
+
+func TestLimitConn(t *testing.T) {
+	l := newLimits()
+	release1, ok1 := l.openConn("10.0.0.1:5000", 2)
+	_, ok2 := l.openConn("10.0.0.1:5001", 2)
+	if !ok1 || !ok2 {
+		t.Fatalf("the first two connections should be allowed")
+	}
+	if _, ok := l.openConn("10.0.0.1:5002", 2); ok {
+		t.Errorf("the third connection should be rejected")
+	}
+	if _, ok := l.openConn("10.0.0.2:5000", 2); !ok {
+		t.Errorf("another client should be allowed")
+	}
+	// a server with a lower limit rejects the requests of the client
+	if l.tooManyConns(&ServerConf{LimitConn: 2}, "10.0.0.1:5000") {
+		t.Errorf("two connections should be allowed with a limit of 2")
+	}
+	if !l.tooManyConns(&ServerConf{LimitConn: 1}, "10.0.0.1:5000") {
+		t.Errorf("two connections should be too many with a limit of 1")
+	}
+	release1()
+	if _, ok := l.openConn("10.0.0.1:5002", 2); !ok {
+		t.Errorf("a connection should be allowed once another one is closed")
+	}
+	// without a limit they're only counted
+	if _, ok := l.openConn("10.0.0.1:5003", 0); !ok {
+		t.Errorf("the connections should be allowed without a limit")
+	}
+}
+
+func TestConnLimit(t *testing.T) {
+	conf := &Conf{
+		DefaultServer: &ServerConf{Ports: []int{80}, LimitConn: 5},
+		Vhosts: []ServerConf{
+			{Ports: []int{80}, LimitConn: 10},
+			{Ports: []int{8080}, LimitConn: -1},
+			{Ports: []int{8081}, Locations: []Location{{Server: ServerConf{LimitConn: 20}}}, LimitConn: 2},
+		},
+	}
+	tests := []struct {
+		port int
+		want int
+	}{
+		{80, 10},
+		// one of the servers has no limit
+		{8080, 0},
+		{8081, 20},
+		// only the default server
+		{8082, 5},
+	}
+	for _, test := range tests {
+		if got := connLimit(conf, test.port); got != test.want {
+			t.Errorf("connLimit(%d) returned %d but want %d", test.port, got, test.want)
+		}
+	}
+}
+
+func TestParseLimitReq(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  float64
+		burst int
+		ok    bool
+	}{
+		{"10r/s", 10, 0, true},
+		{"60r/m burst=5", 1, 5, true},
+		{"off", -1, 0, true},
+		{"10", 0, 0, false},
+		{"10r/h", 0, 0, false},
+		{"0r/s", 0, 0, false},
+		{"10r/s 5", 0, 0, false},
+		{"10r/s burst=-1", 0, 0, false},
+	}
+	for _, test := range tests {
+		rate, burst, err := parseLimitReq(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("parseLimitReq(%q) returned the error %v", test.value, err)
+			continue
+		}
+		if rate != test.rate || burst != test.burst {
+			t.Errorf("parseLimitReq(%q) returned %v and %d but want %v and %d", test.value, rate, burst, test.rate, test.burst)
+		}
+	}
+}
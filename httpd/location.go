@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// location blocks override the options of a server for the uris that they
+// match, they're chosen like nginx does it: an exact match (=) always wins,
+// then the longest prefix if it's marked with ^~, then the first regex
+// (~ or ~* without case) that matches and finally the longest prefix
+
+const (
+	matchPrefix      = ""
+	matchExact       = "="
+	matchPrefixNoRe  = "^~"
+	matchRegex       = "~"
+	matchRegexNoCase = "~*"
+)
+
+// Location is a location block of a server
+type Location struct {
+	// one of the match modifiers, a prefix when it's empty
+	Match string
+	// the prefix or the exact path, or the regex
+	Path string
+	// the options of the location, the ones that are
+	// not set are the same as the ones of its server
+	Server ServerConf
+	re     *regexp.Regexp
+}
+
+// newLocation returns the location of a block from
+// its arguments, like "/images/" or "~* \.png$"
+func newLocation(args []string) (Location, error) {
+	var loc Location
+	switch len(args) {
+	case 1:
+		loc.Path = args[0]
+	case 2:
+		loc.Match, loc.Path = args[0], args[1]
+	default:
+		return loc, fmt.Errorf("%s needs a path or a modifier and a path", locationOption)
+	}
+	switch loc.Match {
+	case matchPrefix, matchExact, matchPrefixNoRe:
+		if !strings.HasPrefix(loc.Path, "/") {
+			return loc, fmt.Errorf("the path %q of a %s must start with /", loc.Path, locationOption)
+		}
+	case matchRegex, matchRegexNoCase:
+		expr := loc.Path
+		if loc.Match == matchRegexNoCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return loc, fmt.Errorf("invalid regex %q: %s", loc.Path, err)
+		}
+		loc.re = re
+	default:
+		return loc, fmt.Errorf("unknown %s modifier %q", locationOption, loc.Match)
+	}
+	return loc, nil
+}
+
+func (l *Location) isRegex() bool {
+	return l.re != nil
+}
+
+// inheritLocation sets the options that were not specified in
+// the location from the ones of its server, the location is
+// always part of the same server so it has the same names and ports
+func (s *ServerConf) inheritLocation(parent *ServerConf, loc *Location) {
+	s.inherit(parent)
+	s.Names = parent.Names
+	s.Ports = parent.Ports
+	s.TLSPorts = parent.TLSPorts
+	s.location = loc
+}
+
+// findLocation returns the configuration of the location that
+// matches the path, or the server itself when none of them do
+func (s *ServerConf) findLocation(p string) *ServerConf {
+	var longest *Location
+	for i := range s.Locations {
+		loc := &s.Locations[i]
+		switch loc.Match {
+		case matchExact:
+			if p == loc.Path {
+				return &loc.Server
+			}
+		case matchPrefix, matchPrefixNoRe:
+			if strings.HasPrefix(p, loc.Path) && (longest == nil || len(loc.Path) > len(longest.Path)) {
+				longest = loc
+			}
+		}
+	}
+	if longest != nil && longest.Match == matchPrefixNoRe {
+		return &longest.Server
+	}
+	for i := range s.Locations {
+		if loc := &s.Locations[i]; loc.isRegex() && loc.re.MatchString(p) {
+			return &loc.Server
+		}
+	}
+	if longest != nil {
+		return &longest.Server
+	}
+	return s
+}
+
+// locationPath returns the path of the request that is
+// matched against the locations, it's cleaned so that
+// "/a/../b" can't skip the location of "/b"
+func locationPath(req *Request) string {
+	p := req.Path()
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// methodAllowed reports whether the server allows the method of the request
+func (s *ServerConf) methodAllowed(method string) bool {
+	if len(s.Methods) == 0 {
+		return true
+	}
+	for _, m := range s.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
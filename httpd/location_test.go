@@ -0,0 +1,110 @@
+package main
+
+import "testing"
+
+func TestFindLocation(t *testing.T) {
+	conf, err := buildServerConf([]byte(`root = /var/www
+location / {
+    root = /var/www/root
+}
+location /images/ {
+    root = /var/www/images
+}
+location ^~ /static/ {
+    root = /var/www/static
+}
+location = /exact {
+    root = /var/www/exact
+}
+location ~ \.php$ {
+    root = /var/www/php
+}
+location ~* \.(png|jpg)$ {
+    root = /var/www/pictures
+}
+location /images/icons/ {
+    root = /var/www/icons
+}
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	srv := conf.DefaultServer
+	tests := []struct {
+		path string
+		root string
+	}{
+		{"/", "/var/www/root"},
+		{"/about", "/var/www/root"},
+		{"/exact", "/var/www/exact"},
+		{"/exact/more", "/var/www/root"},
+		{"/images/a.gif", "/var/www/images"},
+		{"/images/icons/a.gif", "/var/www/icons"},
+		// the regexes win over the prefixes
+		{"/images/a.PNG", "/var/www/pictures"},
+		{"/index.php", "/var/www/php"},
+		// unless the prefix has ^~
+		{"/static/a.png", "/var/www/static"},
+		{"/static/a.php", "/var/www/static"},
+	}
+	for _, test := range tests {
+		if got := srv.findLocation(test.path); got.Root != test.root {
+			t.Errorf("findLocation(%s) returned the root %s but want %s", test.path, got.Root, test.root)
+		}
+	}
+	if got := (&ServerConf{Root: "/var/www"}).findLocation("/a"); got.Root != "/var/www" {
+		t.Errorf("a server without locations should be used for every path")
+	}
+}
+
+func TestLocationInheritsFromServer(t *testing.T) {
+	conf, err := buildServerConf([]byte(`root = /var/www
+index = index.html
+vhost {
+    name = example.com
+    port = 8080
+    location /app/ {
+        index = index.php
+        methods = GET, POST
+    }
+    error_page = error.html
+}
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	vhost := conf.Vhosts[0]
+	if len(vhost.Locations) != 1 {
+		t.Fatalf("the vhost should have one location, got %d", len(vhost.Locations))
+	}
+	loc := vhost.findLocation("/app/users")
+	if loc.Root != "/var/www" || loc.IndexPages[0] != "index.php" || loc.errorPage(404) != "error.html" {
+		t.Errorf("the location was not inherited from its vhost: %+v", loc)
+	}
+	if !loc.isNamed("example.com") || !loc.listensOn(8080) {
+		t.Errorf("the location should have the names and ports of its vhost")
+	}
+	if loc.methodAllowed("DELETE") || !loc.methodAllowed("POST") || !vhost.methodAllowed("DELETE") {
+		t.Errorf("only the location should limit the methods")
+	}
+}
+
+func TestNewLocation(t *testing.T) {
+	tests := []struct {
+		args  []string
+		valid bool
+	}{
+		{[]string{"/"}, true},
+		{[]string{"=", "/exact"}, true},
+		{[]string{"~*", `\.png$`}, true},
+		{[]string{}, false},
+		{[]string{"images"}, false},
+		{[]string{"~", "[a-"}, false},
+		{[]string{"!", "/a"}, false},
+	}
+	for _, test := range tests {
+		if _, err := newLocation(test.args); (err == nil) != test.valid {
+			t.Errorf("newLocation(%q) returned %v", test.args, err)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// access and error logs of every server, the log files are
+// reopened on SIGUSR1 so that they can be rotated
+
+const (
+	LogDebug = iota + 1
+	LogInfo
+	LogNotice
+	LogWarn
+	LogError
+	LogCrit
+)
+
+var logLevels = map[string]int{
+	"debug":  LogDebug,
+	"info":   LogInfo,
+	"notice": LogNotice,
+	"warn":   LogWarn,
+	"error":  LogError,
+	"crit":   LogCrit,
+}
+
+const defaultLogLevel = LogError
+
+const (
+	logOff            = "off"
+	commonLogFormat   = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`
+	combinedLogFormat = commonLogFormat + ` "$http_referer" "$http_user_agent"`
+	defaultLogFormat  = "combined"
+	timeLocalFormat   = "02/Jan/2006:15:04:05 -0700"
+	errorLogTimeFmt   = "2006/01/02 15:04:05"
+)
+
+// logFile is a log file that can be reopened
+type logFile struct {
+	mu   sync.Mutex
+	name string
+	f    *os.File
+}
+
+func openLogFile(name string) (*logFile, error) {
+	l := &logFile{name: name}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen closes the file and opens it again, a new
+// file is created if it was moved (or deleted)
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Logs has every log file used by the servers, a file
+// that is used by more than one server is opened once
+type Logs struct {
+	mu    sync.Mutex
+	files map[string]*logFile
+}
+
+func NewLogs() *Logs {
+	return &Logs{files: make(map[string]*logFile)}
+}
+
+// Open opens every log file of the configuration, the files
+// that are not used by the configuration anymore are closed
+func (l *Logs) Open(conf *Conf) error {
+	names := make(map[string]bool)
+	for _, srv := range conf.servers() {
+		if srv.AccessLog != "" && srv.AccessLog != logOff {
+			names[srv.AccessLog] = true
+		}
+		if srv.ErrorLog != "" && srv.ErrorLog != logOff {
+			names[srv.ErrorLog] = true
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	opened := make(map[string]*logFile)
+	for name := range names {
+		if f, ok := l.files[name]; ok {
+			opened[name] = f
+			continue
+		}
+		f, err := openLogFile(name)
+		if err != nil {
+			// the files that were just opened are not needed
+			for n, f := range opened {
+				if _, ok := l.files[n]; !ok {
+					f.Close()
+				}
+			}
+			return err
+		}
+		opened[name] = f
+	}
+	for name, f := range l.files {
+		if _, ok := opened[name]; !ok {
+			f.Close()
+		}
+	}
+	l.files = opened
+	return nil
+}
+
+// Reopen reopens every log file
+func (l *Logs) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, f := range l.files {
+		if err := f.Reopen(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Logs) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for name, f := range l.files {
+		f.Close()
+		delete(l.files, name)
+	}
+}
+
+func (l *Logs) file(name string) *logFile {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.files[name]
+}
+
+// Access writes the line of the request to the access log of the server
+func (l *Logs) Access(srv *ServerConf, req *Request, res *Response, start time.Time) {
+	if srv == nil || srv.AccessLog == "" || srv.AccessLog == logOff {
+		return
+	}
+	f := l.file(srv.AccessLog)
+	if f == nil {
+		return
+	}
+	line := formatAccessLog(srv.logFormat(), req, res, start)
+	f.Write([]byte(line + "\n"))
+}
+
+// Errorf writes the message to the error log of the server
+// if its level is at least the one that the server logs
+func (l *Logs) Errorf(srv *ServerConf, level int, format string, a ...interface{}) {
+	if srv == nil || srv.ErrorLog == "" || srv.ErrorLog == logOff || level < srv.errorLogLevel() {
+		return
+	}
+	f := l.file(srv.ErrorLog)
+	if f == nil {
+		return
+	}
+	line := fmt.Sprintf("%s [%s] %s\n", time.Now().Format(errorLogTimeFmt), logLevelName(level), fmt.Sprintf(format, a...))
+	f.Write([]byte(line))
+}
+
+func logLevelName(level int) string {
+	for name, l := range logLevels {
+		if l == level {
+			return name
+		}
+	}
+	return ""
+}
+
+// formatAccessLog expands the variables of the log format with
+// the values of the request and of the response sent for it
+func formatAccessLog(format string, req *Request, res *Response, start time.Time) string {
+	switch format {
+	case "common":
+		format = commonLogFormat
+	case "combined":
+		format = combinedLogFormat
+	}
+	return expandVars(format, func(name string) (string, bool) {
+		switch name {
+		case "status":
+			return strconv.Itoa(res.Code), true
+		case "body_bytes_sent":
+			return strconv.FormatInt(res.sent, 10), true
+		case "time_local":
+			return start.Format(timeLocalFormat), true
+		case "request_time":
+			return fmt.Sprintf("%.3f", time.Since(start).Seconds()), true
+		}
+		value, ok := requestVar(req, name)
+		if ok && value == "" {
+			value = "-"
+		}
+		// the quotes of the format can't be closed by a value
+		return strings.ReplaceAll(value, `"`, `\"`), ok
+	})
+}
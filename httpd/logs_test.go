@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatAccessLog(t *testing.T) {
+	req := &Request{
+		Method:           "GET",
+		Uri:              "/index.html?foo=bar",
+		HTTPVersionMajor: 1,
+		HTTPVersionMinor: 1,
+		RemoteAddr:       "127.0.0.1:51234",
+		Headers: textproto.MIMEHeader{
+			"Host":       {"example.com:8080"},
+			"User-Agent": {`curl/7.68.0 "quoted"`},
+		},
+	}
+	res := &Response{Code: 200, sent: 1234}
+	start := time.Date(2021, time.June, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{
+			"common",
+			`127.0.0.1 - - [01/Jun/2021:10:30:00 +0000] "GET /index.html?foo=bar HTTP/1.1" 200 1234`,
+		},
+		{
+			"combined",
+			`127.0.0.1 - - [01/Jun/2021:10:30:00 +0000] "GET /index.html?foo=bar HTTP/1.1" 200 1234 "-" "curl/7.68.0 \"quoted\""`,
+		},
+		{
+			`$host ${request_method} $uri?$args $status $unknown`,
+			`example.com GET /index.html?foo=bar 200 $unknown`,
+		},
+	}
+	for _, test := range tests {
+		if line := formatAccessLog(test.format, req, res, start); line != test.want {
+			t.Errorf("access log line for %q is\n%s\nbut want\n%s", test.format, line, test.want)
+		}
+	}
+}
+
+func TestErrorLogLevels(t *testing.T) {
+	dir := t.TempDir()
+	conf := &Conf{
+		DefaultServer: &ServerConf{ErrorLog: filepath.Join(dir, "error.log"), ErrorLogLevel: "warn"},
+	}
+	logs := NewLogs()
+	if err := logs.Open(conf); err != nil {
+		t.Fatalf("error opening logs: %s", err)
+	}
+	defer logs.Close()
+	logs.Errorf(conf.DefaultServer, LogInfo, "not logged")
+	logs.Errorf(conf.DefaultServer, LogWarn, "a warning")
+	logs.Errorf(conf.DefaultServer, LogCrit, "critical")
+	b, err := os.ReadFile(filepath.Join(dir, "error.log"))
+	if err != nil {
+		t.Fatalf("error reading the error log: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines in the error log but got %d:\n%s", len(lines), b)
+	}
+	if !strings.HasSuffix(lines[0], "[warn] a warning") || !strings.HasSuffix(lines[1], "[crit] critical") {
+		t.Errorf("the error log is not correct:\n%s", b)
+	}
+}
+
+func TestLogsOff(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	// a file named "off" would be created in the working directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Chdir(wd)
+	srv := &ServerConf{AccessLog: logOff, ErrorLog: logOff}
+	logs := NewLogs()
+	if err := logs.Open(&Conf{DefaultServer: srv}); err != nil {
+		t.Fatalf("error opening logs: %s", err)
+	}
+	defer logs.Close()
+	req := &Request{Method: "GET", Uri: "/", HTTPVersionMajor: 1, HTTPVersionMinor: 1}
+	logs.Access(srv, req, &Response{Code: 200}, time.Now())
+	logs.Errorf(srv, LogCrit, "not logged")
+	if _, err := os.Stat(filepath.Join(dir, logOff)); err == nil {
+		t.Errorf("the logs that are off should not be written to a file")
+	}
+}
+
+func TestLogsAreReopened(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "access.log")
+	srv := &ServerConf{AccessLog: name, LogFormat: "$request_uri"}
+	logs := NewLogs()
+	if err := logs.Open(&Conf{DefaultServer: srv}); err != nil {
+		t.Fatalf("error opening logs: %s", err)
+	}
+	defer logs.Close()
+	req := &Request{Method: "GET", Uri: "/one", HTTPVersionMajor: 1, HTTPVersionMinor: 1}
+	logs.Access(srv, req, &Response{Code: 200}, time.Now())
+	// like logrotate does
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	req.Uri = "/two"
+	logs.Access(srv, req, &Response{Code: 200}, time.Now())
+	if err := logs.Reopen(); err != nil {
+		t.Fatalf("error reopening logs: %s", err)
+	}
+	req.Uri = "/three"
+	logs.Access(srv, req, &Response{Code: 200}, time.Now())
+
+	rotated, _ := os.ReadFile(name + ".1")
+	current, _ := os.ReadFile(name)
+	if string(rotated) != "/one\n/two\n" {
+		t.Errorf("the rotated log is %q", rotated)
+	}
+	if string(current) != "/three\n" {
+		t.Errorf("the reopened log is %q", current)
+	}
+}
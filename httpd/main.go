@@ -15,16 +15,21 @@ const (
 	defaultPrefix   = "/usr/local/httpd"
 	defaultConfFile = defaultPrefix + "/conf/httpd.conf"
 	defaultLogFile  = defaultPrefix + "/log/httpd.log"
+	defaultPidFile  = defaultPrefix + "/log/httpd.pid"
 	versionFDesc    = "print current version"
 	confFDesc       = "specify the location of the configuration file"
 	logFDesc        = "specify the location of the log file"
+	testFDesc       = "test the configuration file and exit"
+	signalFDesc     = "send a signal to the running server: stop, reload, reopen or upgrade"
 )
 
 func main() {
 	var (
 		versionF bool
+		testF    bool
 		confF    string
 		logF     string
+		signalF  string
 	)
 	flag.BoolVar(&versionF, "version", false, versionFDesc)
 	flag.BoolVar(&versionF, "v", false, versionFDesc+"(shorthand)")
@@ -32,43 +37,173 @@ func main() {
 	flag.StringVar(&confF, "c", defaultConfFile, confFDesc+"(shorthand)")
 	flag.StringVar(&logF, "log", defaultLogFile, logFDesc)
 	flag.StringVar(&logF, "l", defaultLogFile, logFDesc+"(shorthand)")
+	flag.BoolVar(&testF, "t", false, testFDesc)
+	flag.StringVar(&signalF, "s", "", signalFDesc)
 	flag.Parse()
 
 	if versionF {
 		fmt.Fprintf(os.Stdout, "httpd server v%s\n", Version)
 		os.Exit(0)
 	}
-	// TODO: initialize logging mechanism
 	// TODO: figure out which path to use for the configuration file
 	// either from the -conf option, or configured from the build
 	// the -conf option would override any location set in the build
 	c, err := Load(confF)
+	if signalF != "" {
+		// the configuration has the pid file of the server
+		if err == nil {
+			err = sendSignal(c, signalF)
+		}
+		if err != nil {
+			log.Fatalf("%s, exiting...", err)
+		}
+		os.Exit(0)
+	}
+	if testF {
+		if err == nil {
+			// the certificates are not part of the file but they're needed to
+			// start, and the user files are needed by the requests
+			if _, err = loadCertificates(c); err != nil {
+				log.Print(err)
+			} else if err = checkCredentials(osCredentials{}, c); err != nil {
+				log.Print(err)
+			} else if err = checkAuthFiles(c); err != nil {
+				log.Print(err)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration file %s test failed\n", confF)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "configuration file %s test is successful\n", confF)
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatalf("%s, exiting...", err)
 	}
-	go sigHandler()
-	// start the server
-	if err := Start(c); err != nil {
+	// an upgraded binary keeps running like the old one
+	if c.daemon() && !isDaemon() && !isUpgrade() {
+		if err := daemonize(); err != nil {
+			log.Fatalf("%s, exiting...", err)
+		}
+		os.Exit(0)
+	}
+	logFile, err := openLogFile(logF)
+	if err != nil {
+		// the default log file is not required
+		if isFlagSet("log", "l") {
+			log.Fatalf("%s, exiting...", err)
+		}
+		log.Printf("%s, logging to stderr", err)
+	} else {
+		log.SetOutput(logFile)
+	}
+	if isWorker() {
+		if err := runWorker(c, confF, logFile); err != nil {
+			log.Fatalf("%s, exiting...", err)
+		}
+		return
+	}
+	// the listeners of the binary that is being upgraded
+	inherited, err := inheritedFiles()
+	if err != nil {
+		log.Fatalf("%s, exiting...", err)
+	}
+	upgraded := upgradeFile()
+	pid := os.Getpid()
+	if err := writePidFile(c.pidFile(), pid); err != nil {
+		// the default pid file is not required either
+		if c.PidFile != "" {
+			log.Fatalf("%s, exiting...", err)
+		}
+		log.Printf("%s, running without a pid file", err)
+	}
+	// start the server, or the master process and its workers. A server
+	// that switches to another user couldn't reload, reopen the logs or
+	// upgrade anymore, the master does it for its workers as root
+	if c.Workers > 0 || switchesUser(osCredentials{}, c) {
+		err = runMaster(c, confF, logFile, inherited, upgraded)
+	} else {
+		srv := NewServer(c)
+		if srv.inherited, err = fileListeners(inherited); err != nil {
+			log.Fatalf("%s, exiting...", err)
+		}
+		srv.upgraded = upgraded
+		go sigHandler(srv, confF, logFile)
+		err = srv.Start()
+	}
+	removePidFile(c.pidFile(), pid)
+	if err != nil {
 		log.Fatalf("%s, exiting...", err)
 	}
 }
 
-func sigHandler() {
-	// TODO: goroutine that will be waiting for any signals
-	// that will tell the server to
-	// reload the configuration files (HUP)
-	// or to gracefully shutdown (TERM, INT, QUIT)
+func isFlagSet(names ...string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		for _, n := range names {
+			if f.Name == n {
+				set = true
+			}
+		}
+	})
+	return set
+}
+
+// sigHandler waits for the signals that tell the server to
+// reload the configuration files (HUP)
+// reopen the log files (USR1)
+// start a new binary and shutdown once it's running (USR2)
+// or to gracefully shutdown (TERM, INT, QUIT)
+func sigHandler(srv *Server, confFile string, logFile *logFile) {
 	sigShutdown := make(chan os.Signal, 1)
 	signal.Notify(sigShutdown, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	sigReload := make(chan os.Signal, 1)
-	signal.Notify(sigShutdown, syscall.SIGHUP)
+	signal.Notify(sigReload, syscall.SIGHUP)
+	sigReopen := make(chan os.Signal, 1)
+	signal.Notify(sigReopen, syscall.SIGUSR1)
+	sigUpgrade := make(chan os.Signal, 1)
+	signal.Notify(sigUpgrade, syscall.SIGUSR2)
 
-	select {
-	case <-sigShutdown:
-		// TODO: shutdown the server
-		os.Exit(0)
-	case <-sigReload:
-		// TODO: reload configuration files
-		os.Exit(0)
+	for {
+		select {
+		case <-sigShutdown:
+			log.Printf("shutting down...")
+			if err := srv.Shutdown(); err != nil {
+				log.Print(err)
+			}
+			return
+		case <-sigReload:
+			log.Printf("reloading configuration...")
+			c, err := Load(confFile)
+			if err != nil {
+				log.Printf("%s, keeping the current configuration", err)
+				continue
+			}
+			if err := srv.Reload(c); err != nil {
+				log.Print(err)
+			}
+		case <-sigReopen:
+			if logFile != nil {
+				if err := logFile.Reopen(); err != nil {
+					log.Print(err)
+				}
+			}
+			if err := srv.ReopenLogs(); err != nil {
+				log.Print(err)
+			}
+			log.Printf("log files reopened")
+		case <-sigUpgrade:
+			log.Printf("upgrading the binary...")
+			if err := srv.Upgrade(); err != nil {
+				log.Printf("%s, keeping the current binary", err)
+				continue
+			}
+			log.Printf("shutting down...")
+			if err := srv.Shutdown(); err != nil {
+				log.Print(err)
+			}
+			return
+		}
 	}
 }
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the master process opens the ports and starts the worker processes that
+// handle the connections, the workers get the listeners as open files. The
+// master restarts the workers that exit without being told to, and on a
+// reload it starts new workers and gracefully stops the old ones
+
+// the ports of the listeners passed to a worker, and the file of a pipe
+// that is closed when the master exits (even when it's killed)
+const (
+	listenersEnv = "HTTPD_LISTENERS"
+	workerEnv    = "HTTPD_WORKER"
+)
+
+// a worker that exits sooner than this after being started is restarted
+// after waiting for the same time, a worker that can't start doesn't keep
+// the master busy
+const workerRestartDelay = time.Second
+
+// how long the workers have to exit on their own after
+// the shutdown timeout before they are killed
+const workerKillTimeout = 5 * time.Second
+
+type master struct {
+	exe      string
+	confFile string
+	logFile  *logFile
+	mu       sync.Mutex
+	conf     *Conf
+	files    map[int]*os.File // the listeners by port
+	workers  map[*worker]bool
+	gen      int // incremented on every reload
+	pipeR    *os.File
+	pipeW    *os.File
+	stopping bool
+}
+
+type worker struct {
+	cmd      *exec.Cmd
+	gen      int
+	started  time.Time
+	stopping bool
+	done     chan struct{}
+}
+
+func (c *Conf) workers() int {
+	if c.Workers <= 0 {
+		return 1
+	}
+	return c.Workers
+}
+
+// runMaster opens the ports of the configuration (the inherited ones are
+// already open), starts the workers and blocks until the master is told to
+// shutdown or it's replaced by a new binary
+func runMaster(conf *Conf, confFile string, logFile *logFile, inherited map[int]*os.File, upgraded *os.File) error {
+	// the workers check them too, but by then they can only exit
+	if _, err := loadCertificates(conf); err != nil {
+		return err
+	}
+	if err := checkCredentials(osCredentials{}, conf); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	pipeR, pipeW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	m := &master{
+		exe:      exe,
+		confFile: confFile,
+		logFile:  logFile,
+		conf:     conf,
+		files:    inherited,
+		workers:  make(map[*worker]bool),
+		pipeR:    pipeR,
+		pipeW:    pipeW,
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	m.mu.Lock()
+	if err := m.listen(conf); err != nil {
+		m.mu.Unlock()
+		m.close()
+		return err
+	}
+	for i := 0; i < conf.workers(); i++ {
+		if err := m.startWorker(); err != nil {
+			log.Print(err)
+		}
+	}
+	m.mu.Unlock()
+	notifyUpgrade(upgraded)
+
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			log.Printf("reloading configuration...")
+			if err := m.reload(); err != nil {
+				log.Printf("%s, keeping the current configuration", err)
+			}
+		case syscall.SIGUSR1:
+			if logFile != nil {
+				if err := logFile.Reopen(); err != nil {
+					log.Print(err)
+				}
+			}
+			m.reopen(osCredentials{})
+			log.Printf("log files reopened")
+		case syscall.SIGUSR2:
+			log.Printf("upgrading the binary...")
+			// only the reloads change the files, and they
+			// are handled by this goroutine too
+			if err := upgrade(m.files); err != nil {
+				log.Printf("%s, keeping the current binary", err)
+				continue
+			}
+			log.Printf("shutting down...")
+			m.shutdown()
+			return nil
+		default:
+			log.Printf("shutting down...")
+			m.shutdown()
+			return nil
+		}
+	}
+	return nil
+}
+
+// listen opens the ports of the configuration that are not open yet and
+// closes the ones that are not used anymore, m.mu must be held
+func (m *master) listen(conf *Conf) error {
+	ports, err := getPortsToListen(conf)
+	if err != nil {
+		return err
+	}
+	newPorts := make(map[int]bool)
+	for _, port := range ports {
+		newPorts[port] = true
+		if _, ok := m.files[port]; ok {
+			continue
+		}
+		f, err := listenFile(port)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		m.files[port] = f
+		log.Printf("listening on %d", port)
+	}
+	for port, f := range m.files {
+		if !newPorts[port] {
+			f.Close()
+			delete(m.files, port)
+			log.Printf("stopped listening on %d", port)
+		}
+	}
+	if len(m.files) == 0 {
+		return errors.New("could not listen on any port")
+	}
+	return nil
+}
+
+// listenFile opens a listener on the port and returns its file,
+// the file can be passed to another process
+func listenFile(port int) (*os.File, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return l.(*net.TCPListener).File()
+}
+
+// startWorker starts a worker process with the listeners, m.mu must be held
+func (m *master) startWorker() error {
+	cmd := exec.Command(m.exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	listeners := passListeners(cmd, m.files)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, m.pipeR)
+	cmd.Env = append(os.Environ(), listeners, workerEnv+"="+strconv.Itoa(firstListenerFd+len(m.files)))
+	// the signals of the terminal are only for the master
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting a worker: %w", err)
+	}
+	w := &worker{cmd: cmd, gen: m.gen, started: time.Now(), done: make(chan struct{})}
+	m.workers[w] = true
+	log.Printf("started worker %d", cmd.Process.Pid)
+	go m.wait(w)
+	return nil
+}
+
+// wait waits for the worker to exit and restarts it
+// when it was not told to stop
+func (m *master) wait(w *worker) {
+	w.cmd.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.workers, w)
+	close(w.done)
+	if w.stopping || m.stopping {
+		return
+	}
+	log.Printf("worker %d exited (%s), restarting it", w.cmd.Process.Pid, w.cmd.ProcessState)
+	var delay time.Duration
+	if time.Since(w.started) < workerRestartDelay {
+		delay = workerRestartDelay
+	}
+	time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// the workers of an old configuration are not restarted
+		if m.stopping || w.gen != m.gen {
+			return
+		}
+		if err := m.startWorker(); err != nil {
+			log.Print(err)
+		}
+	})
+}
+
+// reload starts the workers of the new configuration and
+// tells the old ones to stop once they're done
+func (m *master) reload() error {
+	conf, err := Load(m.confFile)
+	if err != nil {
+		return err
+	}
+	if _, err := loadCertificates(conf); err != nil {
+		return err
+	}
+	if err := checkCredentials(osCredentials{}, conf); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopping {
+		return nil
+	}
+	if err := m.listen(conf); err != nil {
+		return err
+	}
+	m.conf = conf
+	m.replaceWorkers()
+	return nil
+}
+
+// reopen tells the workers to reopen their logs, the workers that switched
+// to another user may not be able to open them anymore so they're
+// replaced by new ones that open them as root
+func (m *master) reopen(creds credentials) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopping {
+		return
+	}
+	if switchesUser(creds, m.conf) {
+		m.replaceWorkers()
+		return
+	}
+	for w := range m.workers {
+		w.cmd.Process.Signal(syscall.SIGUSR1)
+	}
+}
+
+// replaceWorkers starts the workers of the current configuration and
+// tells the old ones to stop once they're done, m.mu must be held
+func (m *master) replaceWorkers() {
+	m.gen++
+	old := make([]*worker, 0, len(m.workers))
+	for w := range m.workers {
+		old = append(old, w)
+	}
+	for i := 0; i < m.conf.workers(); i++ {
+		if err := m.startWorker(); err != nil {
+			log.Print(err)
+		}
+	}
+	for _, w := range old {
+		m.stopWorker(w)
+	}
+}
+
+// stopWorker tells the worker to gracefully shutdown, m.mu must be held
+func (m *master) stopWorker(w *worker) {
+	w.stopping = true
+	w.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// shutdown stops every worker and waits for them to exit, the
+// ones that are still running after the shutdown timeout are killed
+func (m *master) shutdown() {
+	m.mu.Lock()
+	m.stopping = true
+	workers := make([]*worker, 0, len(m.workers))
+	for w := range m.workers {
+		workers = append(workers, w)
+		m.stopWorker(w)
+	}
+	timeout := m.conf.shutdownTimeout() + workerKillTimeout
+	m.mu.Unlock()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	expired := false
+	for _, w := range workers {
+		if !expired {
+			select {
+			case <-w.done:
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		log.Printf("worker %d did not exit, killing it", w.cmd.Process.Pid)
+		w.cmd.Process.Kill()
+		<-w.done
+	}
+	m.close()
+}
+
+func (m *master) close() {
+	for _, f := range m.files {
+		f.Close()
+	}
+	m.pipeR.Close()
+	m.pipeW.Close()
+}
+
+func isWorker() bool {
+	return os.Getenv(workerEnv) != ""
+}
+
+// runWorker handles the connections of the listeners
+// opened by the master until it's told to stop
+func runWorker(conf *Conf, confFile string, logFile *logFile) error {
+	listeners, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	srv := NewServer(conf)
+	srv.inherited = listeners
+	go sigHandler(srv, confFile, logFile)
+	go watchMaster(srv, inheritedFd(workerEnv, "master"))
+	return srv.Start()
+}
+
+// watchMaster shuts down the worker when the master exits, the
+// master never writes to the pipe so reading it only ends once
+// it's closed
+func watchMaster(srv *Server, f *os.File) {
+	if f == nil {
+		return
+	}
+	io.Copy(io.Discard, f)
+	log.Printf("the master process exited, shutting down...")
+	if err := srv.Shutdown(); err != nil {
+		log.Print(err)
+	}
+}
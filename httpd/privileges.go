@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// the server is started by root to listen on the ports below 1024, once
+// the ports are open (and the logs and the certificates are loaded) it
+// switches to the user and the group of the configuration. Only the workers
+// switch, the master keeps running as root to open the logs, the
+// certificates and the ports of a reload, a reopen and an upgrade
+
+var ErrRunningAsRoot = errors.New("refusing to run as root, set the user to run as")
+
+// credentials switches the user and the group of the process
+type credentials interface {
+	Geteuid() int
+	Setgroups(gids []int) error
+	Setgid(gid int) error
+	Setuid(uid int) error
+}
+
+// osCredentials switches the credentials of every thread of the process
+type osCredentials struct{}
+
+func (osCredentials) Geteuid() int               { return os.Geteuid() }
+func (osCredentials) Setgroups(gids []int) error { return syscall.Setgroups(gids) }
+func (osCredentials) Setgid(gid int) error       { return syscall.Setgid(gid) }
+func (osCredentials) Setuid(uid int) error       { return syscall.Setuid(uid) }
+
+// ids are the user, the group and the supplementary groups to run as,
+// the ids are -1 when they don't change
+type ids struct {
+	uid    int
+	gid    int
+	groups []int
+}
+
+// lookupIDs returns the ids of the user and of the group, they can be names
+// or numbers. The group of the user is used when the group is not set
+func lookupIDs(userName, groupName string) (ids, error) {
+	res := ids{uid: -1, gid: -1}
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			if u, err = user.LookupId(userName); err != nil {
+				return res, fmt.Errorf("unknown user %s", userName)
+			}
+		}
+		res.uid, _ = strconv.Atoi(u.Uid)
+		res.gid, _ = strconv.Atoi(u.Gid)
+		if gids, err := u.GroupIds(); err == nil {
+			for _, g := range gids {
+				if id, err := strconv.Atoi(g); err == nil {
+					res.groups = append(res.groups, id)
+				}
+			}
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return res, fmt.Errorf("unknown group %s", groupName)
+			}
+		}
+		res.gid, _ = strconv.Atoi(g.Gid)
+	}
+	return res, nil
+}
+
+// checkCredentials checks that the user and the group of the configuration
+// exist, they're only used (and needed) when the server is started by root
+func checkCredentials(creds credentials, conf *Conf) error {
+	if creds.Geteuid() != 0 {
+		return nil
+	}
+	// the group alone would keep the server running as root
+	if conf.User == "" {
+		return ErrRunningAsRoot
+	}
+	_, err := lookupIDs(conf.User, conf.Group)
+	return err
+}
+
+// switchesUser reports whether dropPrivileges changes the user or the
+// group of the process, the server can't go back to root after that
+func switchesUser(creds credentials, conf *Conf) bool {
+	if creds.Geteuid() != 0 {
+		return false
+	}
+	id, err := lookupIDs(conf.User, conf.Group)
+	if err != nil {
+		return false
+	}
+	return id.uid > 0 || id.gid > 0
+}
+
+// dropPrivileges switches to the user and the group of the configuration,
+// nothing changes when the server is not started by root
+func dropPrivileges(creds credentials, conf *Conf) error {
+	if err := checkCredentials(creds, conf); err != nil {
+		return err
+	}
+	if creds.Geteuid() != 0 {
+		return nil
+	}
+	id, err := lookupIDs(conf.User, conf.Group)
+	if err != nil {
+		return err
+	}
+	// the groups go first, root is needed to change them
+	if id.gid != -1 {
+		if err := creds.Setgroups(append([]int{id.gid}, id.groups...)); err != nil {
+			return fmt.Errorf("error setting the groups: %w", err)
+		}
+		if err := creds.Setgid(id.gid); err != nil {
+			return fmt.Errorf("error switching to the group %d: %w", id.gid, err)
+		}
+	}
+	if id.uid != -1 {
+		if err := creds.Setuid(id.uid); err != nil {
+			return fmt.Errorf("error switching to the user %d: %w", id.uid, err)
+		}
+	}
+	log.Printf("running as uid %d and gid %d", os.Getuid(), os.Getgid())
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/user"
+	"reflect"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeCredentials records the calls that switch the credentials
+type fakeCredentials struct {
+	euid  int
+	calls []string
+}
+
+func (c *fakeCredentials) Geteuid() int { return c.euid }
+
+func (c *fakeCredentials) Setgroups(gids []int) error {
+	c.calls = append(c.calls, "setgroups "+strconv.Itoa(gids[0]))
+	return nil
+}
+
+func (c *fakeCredentials) Setgid(gid int) error {
+	c.calls = append(c.calls, "setgid "+strconv.Itoa(gid))
+	return nil
+}
+
+func (c *fakeCredentials) Setuid(uid int) error {
+	c.calls = append(c.calls, "setuid "+strconv.Itoa(uid))
+	return nil
+}
+
+func TestDropPrivileges(t *testing.T) {
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("the nobody user does not exist")
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Skip("the group of nobody does not exist")
+	}
+	tests := []struct {
+		euid  int
+		conf  *Conf
+		calls []string
+		err   error
+	}{
+		{
+			0,
+			&Conf{User: "nobody"},
+			[]string{"setgroups " + u.Gid, "setgid " + u.Gid, "setuid " + u.Uid},
+			nil,
+		},
+		{
+			0,
+			&Conf{User: u.Uid, Group: g.Name},
+			[]string{"setgroups " + u.Gid, "setgid " + u.Gid, "setuid " + u.Uid},
+			nil,
+		},
+		// the group alone would keep the uid of root
+		{0, &Conf{Group: g.Name}, nil, ErrRunningAsRoot},
+		{0, &Conf{}, nil, ErrRunningAsRoot},
+		// only root can switch
+		{1000, &Conf{}, nil, nil},
+		{1000, &Conf{User: "nobody"}, nil, nil},
+	}
+	for i, test := range tests {
+		creds := &fakeCredentials{euid: test.euid}
+		err := dropPrivileges(creds, test.conf)
+		if !errors.Is(err, test.err) {
+			t.Errorf("#%d dropPrivileges returned the error %v but want %v", i+1, err, test.err)
+		}
+		if !reflect.DeepEqual(creds.calls, test.calls) {
+			t.Errorf("#%d dropPrivileges made the calls %v but want %v", i+1, creds.calls, test.calls)
+		}
+	}
+	creds := &fakeCredentials{euid: 0}
+	if err := dropPrivileges(creds, &Conf{User: "not-a-user-of-this-system"}); err == nil || creds.calls != nil {
+		t.Errorf("an unknown user should fail before switching, got %v and %v", err, creds.calls)
+	}
+}
+
+func TestSwitchesUser(t *testing.T) {
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("the nobody user does not exist")
+	}
+	tests := []struct {
+		euid     int
+		conf     *Conf
+		switches bool
+	}{
+		{0, &Conf{User: "nobody"}, true},
+		{0, &Conf{User: "root"}, false},
+		{0, &Conf{User: "root", Group: "nogroup"}, true},
+		{0, &Conf{User: "not-a-user-of-this-system"}, false},
+		{1000, &Conf{User: "nobody"}, false},
+	}
+	for i, test := range tests {
+		if test.conf.Group != "" {
+			if _, err := user.LookupGroup(test.conf.Group); err != nil {
+				continue
+			}
+		}
+		creds := &fakeCredentials{euid: test.euid}
+		if switches := switchesUser(creds, test.conf); switches != test.switches {
+			t.Errorf("#%d switchesUser returned %v but want %v", i+1, switches, test.switches)
+		}
+		if creds.calls != nil {
+			t.Errorf("#%d switchesUser should not switch, got the calls %v", i+1, creds.calls)
+		}
+	}
+}
+
+func TestMasterReopen(t *testing.T) {
+	if _, err := user.Lookup("nobody"); err != nil {
+		t.Skip("the nobody user does not exist")
+	}
+	pipeR, pipeW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() *worker {
+		cmd := exec.Command("sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Skip("the workers can't be faked")
+		}
+		return &worker{cmd: cmd, started: time.Now(), done: make(chan struct{})}
+	}
+	tests := []struct {
+		euid     int
+		replaced bool
+	}{
+		// the worker that is not root anymore can't open the logs
+		{0, true},
+		// the worker reopens them on its own
+		{1000, false},
+	}
+	for i, test := range tests {
+		w := start()
+		m := &master{
+			exe:     "true",
+			conf:    &Conf{User: "nobody"},
+			files:   make(map[int]*os.File),
+			workers: map[*worker]bool{w: true},
+			pipeR:   pipeR,
+			pipeW:   pipeW,
+		}
+		m.reopen(&fakeCredentials{euid: test.euid})
+		err := w.cmd.Wait()
+		m.mu.Lock()
+		m.stopping = true
+		replaced := m.gen == 1 && w.stopping
+		m.mu.Unlock()
+		if replaced != test.replaced {
+			t.Errorf("#%d reopen replaced the workers: %v but want %v", i+1, replaced, test.replaced)
+		}
+		sig := syscall.SIGUSR1
+		if test.replaced {
+			sig = syscall.SIGTERM
+		}
+		if status, ok := w.cmd.ProcessState.Sys().(syscall.WaitStatus); !ok || !status.Signaled() || status.Signal() != sig {
+			t.Errorf("#%d the worker should get %s, got %v", i+1, sig, err)
+		}
+	}
+	pipeR.Close()
+	pipeW.Close()
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reverse proxy, the requests are sent to one of the servers of an upstream
+// and their responses are sent back to the client, the servers that fail
+// are not used for a while and idle connections are kept open for reuse
+
+const (
+	proxyConnectTimeout = 10 * time.Second
+	// how long to wait for each read or write of an upstream connection
+	proxyTimeout = 60 * time.Second
+)
+
+var (
+	ErrNoLiveUpstreams      = errors.New("no live upstreams")
+	ErrInvalidProxyResponse = errors.New("invalid response from the upstream")
+)
+
+// the headers that only apply to a single connection, they're never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upstreams are the upstreams of the configuration by their name,
+// a proxy_pass to a single server has an upstream named after it
+type upstreams map[string]*upstream
+
+type upstream struct {
+	name        string
+	balance     string
+	maxFails    int
+	failTimeout time.Duration
+	backends    []*backend
+	next        uint32 // the next backend for round robin
+}
+
+// backend is a server of an upstream
+type backend struct {
+	addr      string
+	mu        sync.Mutex
+	maxIdle   int
+	active    int
+	fails     int
+	downUntil time.Time
+	idle      []net.Conn
+}
+
+// buildUpstreams returns the upstreams used by the configuration, the
+// backends of the old upstreams are kept (with their idle connections
+// and failures) when they're still part of the same upstream
+func buildUpstreams(conf *Conf, old upstreams) upstreams {
+	ups := make(upstreams)
+	add := func(uc *UpstreamConf) {
+		up := &upstream{
+			name:        uc.Name,
+			balance:     uc.Balance,
+			maxFails:    uc.maxFails(),
+			failTimeout: uc.failTimeout(),
+		}
+		for _, addr := range uc.Servers {
+			var b *backend
+			if prev := old[uc.Name]; prev != nil {
+				b = prev.backend(addr)
+			}
+			if b == nil {
+				b = &backend{addr: addr}
+			}
+			b.mu.Lock()
+			b.maxIdle = uc.keepAlive()
+			b.mu.Unlock()
+			up.backends = append(up.backends, b)
+		}
+		ups[uc.Name] = up
+	}
+	for i := range conf.Upstreams {
+		add(&conf.Upstreams[i])
+	}
+	servers := conf.servers()
+	for _, srv := range conf.servers() {
+		for i := range srv.Locations {
+			servers = append(servers, &srv.Locations[i].Server)
+		}
+	}
+	for _, srv := range servers {
+		if srv.ProxyPass == "" {
+			continue
+		}
+		u, err := url.Parse(srv.ProxyPass)
+		if err != nil {
+			continue
+		}
+		if _, ok := ups[u.Host]; ok {
+			continue
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Host, "80")
+		}
+		add(&UpstreamConf{Name: u.Host, Servers: []string{addr}})
+	}
+	// the connections to the servers that are not used anymore
+	for name, up := range old {
+		for _, b := range up.backends {
+			if ups[name] == nil || ups[name].backend(b.addr) != b {
+				b.closeIdle()
+			}
+		}
+	}
+	return ups
+}
+
+func (u *upstream) backend(addr string) *backend {
+	for _, b := range u.backends {
+		if b.addr == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+// pick returns the backend for the next request, the ones that are
+// down or that were already tried for the request are skipped
+func (u *upstream) pick(clientIP string, tried map[*backend]bool) *backend {
+	n := len(u.backends)
+	if n == 0 {
+		return nil
+	}
+	now := time.Now()
+	usable := func(b *backend) bool {
+		return !tried[b] && b.available(now)
+	}
+	var start int
+	switch u.balance {
+	case balanceLeastConn:
+		var best *backend
+		bestActive := 0
+		for _, b := range u.backends {
+			if !usable(b) {
+				continue
+			}
+			if active := b.activeConns(); best == nil || active < bestActive {
+				best, bestActive = b, active
+			}
+		}
+		return best
+	case balanceIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(clientIP))
+		start = int(h.Sum32() % uint32(n))
+	default:
+		start = int((atomic.AddUint32(&u.next, 1) - 1) % uint32(n))
+	}
+	for i := 0; i < n; i++ {
+		if b := u.backends[(start+i)%n]; usable(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (b *backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.downUntil)
+}
+
+func (b *backend) activeConns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// failed counts a failure of the backend, it returns
+// true when the backend is not going to be used for a while
+func (b *backend) failed(maxFails int, failTimeout time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fails++
+	if b.fails < maxFails {
+		return false
+	}
+	b.fails = 0
+	b.downUntil = time.Now().Add(failTimeout)
+	return true
+}
+
+func (b *backend) succeeded() {
+	b.mu.Lock()
+	b.fails = 0
+	b.mu.Unlock()
+}
+
+// conn returns an idle connection to the backend, or a new one when
+// there's none or when fresh is set, reused tells which one it is
+func (b *backend) conn(fresh bool) (net.Conn, bool, error) {
+	b.mu.Lock()
+	b.active++
+	if !fresh && len(b.idle) > 0 {
+		c := b.idle[len(b.idle)-1]
+		b.idle = b.idle[:len(b.idle)-1]
+		b.mu.Unlock()
+		return c, true, nil
+	}
+	b.mu.Unlock()
+	c, err := net.DialTimeout("tcp", b.addr, proxyConnectTimeout)
+	if err != nil {
+		b.release(nil)
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+// release ends the use of a connection, it's kept open for
+// the next request when it's not nil and there's room for it
+func (b *backend) release(c net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active--
+	if c == nil {
+		return
+	}
+	if len(b.idle) >= b.maxIdle {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	b.idle = append(b.idle, c)
+}
+
+func (b *backend) closeIdle() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.idle {
+		c.Close()
+	}
+	b.idle = nil
+}
+
+// timeoutConn sets the deadline of the connection before every read and write
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c timeoutConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+func (c timeoutConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// bodyError is an error found when reading the body of the
+// client, it's not a failure of the upstream
+type bodyError struct {
+	err error
+}
+
+func (e *bodyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *bodyError) Unwrap() error {
+	return e.err
+}
+
+// bodyErrReader wraps the errors of the reader with a bodyError
+type bodyErrReader struct {
+	r    io.Reader
+	read bool // whether anything was read
+}
+
+func (b *bodyErrReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		b.read = true
+	}
+	if err != nil && err != io.EOF {
+		err = &bodyError{err}
+	}
+	return n, err
+}
+
+// proxyResponse sends the request to a server of the upstream of the
+// proxy_pass of the server and returns its response, other servers are
+// tried when the request fails as long as its body was not sent yet
+func (s *Server) proxyResponse(req *Request, srv *ServerConf) (*Response, error) {
+	target, err := url.Parse(srv.ProxyPass)
+	if err != nil {
+		return nil, err
+	}
+	up := (*s.upstreams.Load())[target.Host]
+	if up == nil {
+		return nil, fmt.Errorf("upstream %s not found", target.Host)
+	}
+	clientIP, _ := requestVar(req, "remote_addr")
+	body := &bodyErrReader{r: req.Body}
+	tried := make(map[*backend]bool)
+	err = ErrNoLiveUpstreams
+	for {
+		b := up.pick(clientIP, tried)
+		if b == nil {
+			return nil, err
+		}
+		tried[b] = true
+		var res *Response
+		res, err = s.proxyTo(b, req, body, proxyURI(target, req, srv), target.Host)
+		if err == nil {
+			// a backend that keeps failing can still answer, its
+			// response is sent but it counts as one more failure
+			if failingStatus(res.Code) {
+				s.upstreamFailed(srv, up, b, req, fmt.Errorf("status %d", res.Code))
+			} else {
+				b.succeeded()
+			}
+			return res, nil
+		}
+		var berr *bodyError
+		if errors.As(err, &berr) {
+			return nil, err
+		}
+		s.upstreamFailed(srv, up, b, req, err)
+		if body.read {
+			// the body can't be sent again
+			return nil, err
+		}
+	}
+}
+
+// upstreamFailed counts a failure of the backend, it's not
+// used for a while after too many of them
+func (s *Server) upstreamFailed(srv *ServerConf, up *upstream, b *backend, req *Request, err error) {
+	s.logs.Errorf(srv, LogError, "upstream %s (%s) failed for %s %s: %s", up.name, b.addr, req.Method, req.Uri, err)
+	if b.failed(up.maxFails, up.failTimeout) {
+		s.logs.Errorf(srv, LogWarn, "upstream %s (%s) is not used for %s", up.name, b.addr, up.failTimeout)
+	}
+}
+
+// failingStatus reports whether the status code of a response
+// tells that the backend itself is failing
+func failingStatus(code int) bool {
+	return code == StatusBadGateway || code == StatusServiceUnavailable || code == StatusGatewayTimeout
+}
+
+// proxyURI returns the uri of the upstream request, when the proxy_pass has
+// a path it replaces the prefix of the location (or the leading "/" outside
+// of a location), the uri is sent unchanged for regex locations
+func proxyURI(target *url.URL, req *Request, srv *ServerConf) string {
+	uri := req.Uri
+	if u, err := url.ParseRequestURI(req.Uri); err == nil && u.Host != "" {
+		// the uri is in absolute form
+		uri = u.RequestURI()
+	}
+	if target.Path == "" {
+		return uri
+	}
+	prefix := "/"
+	if srv.location != nil {
+		if srv.location.isRegex() {
+			return uri
+		}
+		prefix = srv.location.Path
+	}
+	if strings.HasPrefix(uri, prefix) {
+		uri = target.Path + strings.TrimPrefix(uri, prefix)
+	}
+	return uri
+}
+
+// proxyTo sends the request to the backend and reads the headers of
+// its response, a connection that was idle is only used for requests
+// without a body, the backend could have closed it in the meantime
+func (s *Server) proxyTo(b *backend, req *Request, body *bodyErrReader, uri string, proxyHost string) (*Response, error) {
+	hasBody := req.ContentLength != 0
+	for attempt := 0; ; attempt++ {
+		c, reused, err := b.conn(hasBody || attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		conn := timeoutConn{c, proxyTimeout}
+		if err := writeProxyRequest(conn, req, body, uri, proxyHost); err != nil {
+			c.Close()
+			b.release(nil)
+			if reused && !hasBody {
+				continue
+			}
+			return nil, err
+		}
+		br := bufio.NewReader(conn)
+		res, keepAlive, err := readProxyResponse(br, req)
+		if err != nil {
+			c.Close()
+			b.release(nil)
+			if reused && !hasBody && err == io.EOF {
+				// the idle connection was closed by the backend
+				continue
+			}
+			return nil, err
+		}
+		pb := &proxyBody{r: res.Body, conn: c, b: b, keepAlive: keepAlive, left: res.ContentLength}
+		if _, ok := res.Body.(eofReader); ok || !res.hasBody() || req.Method == RequestMethodHead {
+			pb.left = 0
+		}
+		res.Body = pb
+		return res, nil
+	}
+}
+
+// writeProxyRequest sends the request line, the headers and the body of the
+// request to the upstream, the Host header of the client is kept and the
+// host of the proxy_pass is only used when the client didn't send one
+func writeProxyRequest(w io.Writer, req *Request, body io.Reader, uri string, proxyHost string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, uri)
+
+	headers := make(textproto.MIMEHeader)
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	removeHopByHopHeaders(headers)
+	headers.Del("Expect")
+	clientIP, _ := requestVar(req, "remote_addr")
+	if prior := headers.Get("X-Forwarded-For"); prior != "" {
+		clientIP = prior + ", " + clientIP
+	}
+	headers.Set("X-Forwarded-For", clientIP)
+	scheme, _ := requestVar(req, "scheme")
+	headers.Set("X-Forwarded-Proto", scheme)
+	if host := headers.Get("Host"); host != "" {
+		headers.Set("X-Forwarded-Host", host)
+	} else {
+		headers.Set("Host", proxyHost)
+	}
+	headers.Del("Content-Length")
+	if req.ContentLength > 0 {
+		headers.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	} else if req.ContentLength < 0 {
+		headers.Set("Transfer-Encoding", "chunked")
+	}
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range headers[k] {
+			fmt.Fprintf(bw, "%s: %s\r\n", k, v)
+		}
+	}
+	bw.WriteString("\r\n")
+
+	switch {
+	case req.ContentLength > 0:
+		if _, err := io.CopyN(bw, body, req.ContentLength); err != nil {
+			return err
+		}
+	case req.ContentLength < 0:
+		cw := &chunkedWriter{bw}
+		if _, err := io.Copy(cw, body); err != nil {
+			return err
+		}
+		if err := cw.Close(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// readProxyResponse reads the status line and the headers of the response
+// of the upstream, the informational responses are skipped. It also returns
+// whether the connection can be used for another request
+func readProxyResponse(br *bufio.Reader, req *Request) (*Response, bool, error) {
+	tr := textproto.NewReader(br)
+	var code int
+	var msg string
+	var minor int
+	for {
+		line, err := tr.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		code, msg, minor, err = parseStatusLine(line)
+		if err != nil {
+			return nil, false, err
+		}
+		headers, err := tr.ReadMIMEHeader()
+		if err != nil {
+			return nil, false, ErrInvalidProxyResponse
+		}
+		if code >= StatusOk {
+			return proxyResponseFrom(tr, code, msg, minor, headers, req)
+		}
+	}
+}
+
+// parseStatusLine parses a line like "HTTP/1.1 200 OK"
+func parseStatusLine(line string) (int, string, int, error) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/1.") {
+		return 0, "", 0, ErrInvalidProxyResponse
+	}
+	minor, err := strconv.Atoi(strings.TrimPrefix(parts[0], "HTTP/1."))
+	if err != nil {
+		return 0, "", 0, ErrInvalidProxyResponse
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 || code > 999 {
+		return 0, "", 0, ErrInvalidProxyResponse
+	}
+	msg := ""
+	if len(parts) == 3 {
+		msg = parts[2]
+	}
+	return code, msg, minor, nil
+}
+
+func proxyResponseFrom(tr *textproto.Reader, code int, msg string, minor int, headers textproto.MIMEHeader, req *Request) (*Response, bool, error) {
+	keepAlive := minor >= 1
+	for _, v := range headers.Values("Connection") {
+		for _, opt := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(opt), "close") {
+				keepAlive = false
+			}
+		}
+	}
+	chunked := strings.EqualFold(headers.Get("Transfer-Encoding"), "chunked")
+	cl := headers.Get("Content-Length")
+	removeHopByHopHeaders(headers)
+	headers.Del("Content-Length")
+
+	var body io.Reader
+	length := int64(-1)
+	switch {
+	case req.Method == RequestMethodHead || code == StatusNoContent || code == StatusNotModified:
+		body = eofReader{}
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && n >= 0 {
+			length = n
+		}
+	case chunked:
+		body = &chunkedReader{tr: tr}
+	case cl != "":
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return nil, false, ErrInvalidProxyResponse
+		}
+		body, length = io.LimitReader(tr.R, n), n
+	default:
+		// the body ends when the connection is closed
+		body = tr.R
+		keepAlive = false
+	}
+	res := NewResponse(code, headers, body, length)
+	if msg != "" {
+		res.Message = msg
+	}
+	return res, keepAlive, nil
+}
+
+// removeHopByHopHeaders removes the headers that only apply to a single
+// connection, including the ones listed in the Connection header
+func removeHopByHopHeaders(headers textproto.MIMEHeader) {
+	for _, v := range headers.Values("Connection") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				headers.Del(h)
+			}
+		}
+	}
+	for _, h := range hopByHopHeaders {
+		headers.Del(h)
+	}
+}
+
+// proxyBody is the body of a response from an upstream, the connection
+// goes back to the backend once the body is read to the end
+type proxyBody struct {
+	r         io.Reader
+	conn      net.Conn
+	b         *backend
+	keepAlive bool
+	left      int64 // bytes left of the body, -1 when it's unknown
+	done      bool
+	closed    bool
+}
+
+func (p *proxyBody) Read(buf []byte) (int, error) {
+	if p.left == 0 {
+		return 0, io.EOF
+	}
+	n, err := p.r.Read(buf)
+	if p.left > 0 {
+		p.left -= int64(n)
+	}
+	if err == io.EOF {
+		p.done = true
+		if p.left > 0 {
+			err = io.ErrUnexpectedEOF
+			p.done = false
+		}
+	}
+	return n, err
+}
+
+func (p *proxyBody) Close() error {
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if (p.left == 0 || p.done) && p.keepAlive {
+		p.b.release(p.conn)
+		return nil
+	}
+	p.b.release(nil)
+	return p.conn.Close()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func testUpstream(balance string, addrs ...string) *upstream {
+	up := &upstream{name: "backend", balance: balance, maxFails: 2, failTimeout: time.Minute}
+	for _, addr := range addrs {
+		up.backends = append(up.backends, &backend{addr: addr})
+	}
+	return up
+}
+
+func TestRoundRobin(t *testing.T) {
+	up := testUpstream(balanceRoundRobin, "a:80", "b:80", "c:80")
+	// b is down after failing twice in a row
+	up.backends[1].failed(up.maxFails, up.failTimeout)
+	if up.backends[1].available(time.Now()) != true {
+		t.Errorf("a single failure should not take the backend down")
+	}
+	up.backends[1].failed(up.maxFails, up.failTimeout)
+	got := make([]string, 0)
+	for i := 0; i < 4; i++ {
+		got = append(got, up.pick("", nil).addr)
+	}
+	want := []string{"a:80", "c:80", "c:80", "a:80"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("round robin picked %v but want %v", got, want)
+		}
+	}
+	if !up.backends[1].available(time.Now().Add(2 * time.Minute)) {
+		t.Errorf("the backend should be used again after the fail timeout")
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	up := testUpstream(balanceLeastConn, "a:80", "b:80", "c:80")
+	up.backends[0].active = 3
+	up.backends[1].active = 1
+	up.backends[2].active = 2
+	if b := up.pick("", nil); b.addr != "b:80" {
+		t.Errorf("least_conn picked %s but want b:80", b.addr)
+	}
+	tried := map[*backend]bool{up.backends[1]: true}
+	if b := up.pick("", tried); b.addr != "c:80" {
+		t.Errorf("least_conn picked %s but want c:80 when b:80 was tried", b.addr)
+	}
+}
+
+func TestIPHash(t *testing.T) {
+	up := testUpstream(balanceIPHash, "a:80", "b:80", "c:80")
+	first := up.pick("10.0.0.1", nil)
+	for i := 0; i < 5; i++ {
+		if b := up.pick("10.0.0.1", nil); b != first {
+			t.Fatalf("ip_hash should always pick %s for the same address, got %s", first.addr, b.addr)
+		}
+	}
+	// the next backend is used while it's down
+	first.failed(1, time.Minute)
+	if b := up.pick("10.0.0.1", nil); b == first || b == nil {
+		t.Errorf("ip_hash should not pick a backend that is down")
+	}
+	for _, b := range up.backends {
+		b.failed(1, time.Minute)
+	}
+	if b := up.pick("10.0.0.1", nil); b != nil {
+		t.Errorf("nothing should be picked when every backend is down, got %s", b.addr)
+	}
+}
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	headers := textproto.MIMEHeader{
+		"Connection":        {"close, X-Private"},
+		"X-Private":         {"secret"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Content-Type":      {"text/plain"},
+	}
+	removeHopByHopHeaders(headers)
+	if len(headers) != 1 || headers.Get("Content-Type") != "text/plain" {
+		t.Errorf("only Content-Type should be left, got %v", headers)
+	}
+}
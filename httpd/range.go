@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// byte ranges of the static files (RFC 7233), a single range is sent as
+// the body of the response and multiple ones as a multipart/byteranges body
+
+// how many ranges a request can ask for, the whole
+// file is sent to requests that ask for more
+const maxRanges = 32
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a range of the file, both ends are included
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+func (r byteRange) length() int64 {
+	return r.end - r.start + 1
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, size)
+}
+
+// parseRange parses the Range header for a file of the size, nil is returned
+// when the header is invalid (so it's ignored) and errRangeNotSatisfiable
+// when none of the ranges are part of the file
+func parseRange(header string, size int64) ([]byteRange, error) {
+	header = strings.TrimSpace(header)
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+	ranges := make([]byteRange, 0)
+	specs := 0
+	for _, s := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(s, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		specs++
+		var r byteRange
+		if first == "" {
+			// the last bytes of the file, like "-500"
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{size - n, size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r = byteRange{start, end}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		if specs > 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		return nil, nil
+	}
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the ranges can be sent, the If-Range header
+// has the ETag or the Last-Modified date of the file that the client has
+// and the whole file is sent when it changed
+func ifRangeMatches(req *Request, etag string, modTime time.Time) bool {
+	value := strings.TrimSpace(req.Headers.Get("If-Range"))
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return etagMatches(value, etag, false)
+	}
+	t, ok := parseHTTPDate(value)
+	return ok && modTime.Truncate(time.Second).Equal(t)
+}
+
+// rangeResponse returns the response with the ranges of the file that the
+// request asks for, it's nil when the whole file has to be sent
+func rangeResponse(req *Request, f *os.File, size int64, headers textproto.MIMEHeader, etag string, modTime time.Time) *Response {
+	header := req.Headers.Get("Range")
+	if header == "" || (req.Method != RequestMethodGet && req.Method != RequestMethodHead) {
+		return nil
+	}
+	if !ifRangeMatches(req, etag, modTime) {
+		return nil
+	}
+	ranges, err := parseRange(header, size)
+	if err != nil {
+		headers.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return NewResponse(StatusRangeNotSatisfiable, headers, nil, 0)
+	}
+	if ranges == nil {
+		return nil
+	}
+	if len(ranges) == 1 {
+		r := ranges[0]
+		headers.Set("Content-Range", r.contentRange(size))
+		body := struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(f, r.start, r.length()), f}
+		return NewResponse(StatusPartialContent, headers, body, r.length())
+	}
+	boundary := randomBoundary()
+	contentType := headers.Get("Content-Type")
+	parts := make([]io.Reader, 0, len(ranges)*2+1)
+	length := int64(0)
+	for i, r := range ranges {
+		h := fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.contentRange(size))
+		if i > 0 {
+			h = "\r\n" + h
+		}
+		parts = append(parts, strings.NewReader(h), io.NewSectionReader(f, r.start, r.length()))
+		length += int64(len(h)) + r.length()
+	}
+	end := fmt.Sprintf("\r\n--%s--\r\n", boundary)
+	parts = append(parts, strings.NewReader(end))
+	length += int64(len(end))
+	headers.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	body := struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(parts...), f}
+	return NewResponse(StatusPartialContent, headers, body, length)
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-499", 1000, []byteRange{{0, 499}}, nil},
+		{"bytes=500-", 1000, []byteRange{{500, 999}}, nil},
+		{"bytes=-200", 1000, []byteRange{{800, 999}}, nil},
+		{"bytes=-2000", 1000, []byteRange{{0, 999}}, nil},
+		{"bytes=900-2000", 1000, []byteRange{{900, 999}}, nil},
+		{"bytes=0-0, -1", 1000, []byteRange{{0, 0}, {999, 999}}, nil},
+		{"bytes= 0-9 , 20-29", 1000, []byteRange{{0, 9}, {20, 29}}, nil},
+		// the ranges outside of the file are skipped
+		{"bytes=0-9, 2000-3000", 1000, []byteRange{{0, 9}}, nil},
+		{"bytes=1000-", 1000, nil, errRangeNotSatisfiable},
+		{"bytes=-0", 1000, nil, errRangeNotSatisfiable},
+		{"bytes=0-", 0, nil, errRangeNotSatisfiable},
+		// invalid headers are ignored
+		{"bytes=", 1000, nil, nil},
+		{"bytes=9-0", 1000, nil, nil},
+		{"bytes=a-b", 1000, nil, nil},
+		{"bytes=10", 1000, nil, nil},
+		{"items=0-9", 1000, nil, nil},
+	}
+	for _, test := range tests {
+		got, err := parseRange(test.header, test.size)
+		if err != test.err {
+			t.Errorf("parseRange(%q, %d) returned the error %v but want %v", test.header, test.size, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseRange(%q, %d) returned %v but want %v", test.header, test.size, got, test.want)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"net"
 	"net/textproto"
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
@@ -28,8 +30,12 @@ var (
 	ErrInvalidRequestLine      = errors.New("invalid request line")
 	ErrInvalidRequestMethod    = errors.New("invalid request method")
 	ErrInvalidHTTPVersion      = errors.New("invalid http version")
-	ErrRequestBodyRequired     = errors.New("request body required")
 	ErrHTTPVersionNotSupported = errors.New("http version not supported")
+	ErrInvalidHost             = errors.New("invalid host")
+	ErrInvalidContentLength    = errors.New("invalid content length")
+	ErrUnsupportedEncoding     = errors.New("unsupported transfer encoding")
+	ErrRequestLineTooLong      = errors.New("request line too long")
+	ErrHeadersTooLarge         = errors.New("request headers too large")
 )
 var httpRegex = regexp.MustCompile(`HTTP\/\d{1}\.\d{1}`)
 
@@ -42,8 +48,27 @@ type Request struct {
 	HTTPVersionMinor int
 	Headers          textproto.MIMEHeader
 	Body             io.Reader
-	r                io.Reader
-	tr               *textproto.Reader
+	// the length of the body, -1 when it's chunked
+	ContentLength int64
+	// the headers sent after a chunked body
+	Trailers textproto.MIMEHeader
+	// the address of the client that sent the request
+	RemoteAddr string
+	// whether the request was sent over TLS
+	TLS bool
+	// the uri of the request line, Uri can be changed by a rewrite
+	requestURI string
+	// the user of the basic authentication
+	remoteUser string
+	// the body that sends "100 Continue" when the client expects it
+	expect *continueReader
+	// the maximum size of the request line and of the headers, and
+	// how many headers there can be, the defaults are used when 0
+	maxRequestLine int
+	maxHeaderSize  int
+	maxHeaders     int
+	r              io.Reader
+	tr             *textproto.Reader
 }
 
 func (r *Request) Parse() error {
@@ -56,18 +81,114 @@ func (r *Request) Parse() error {
 	if err := r.parseRequestHeaders(); err != nil {
 		return err
 	}
-	if r.Method == RequestMethodPost {
-		// TODO: setting the body to a reader for now
-		// not sure how an HTTP server should handle the body
-		// of the request, maybe it sends it to whatever
-		// script/service needs it!
-		r.Body = r.tr.R
+	if err := r.parseBody(); err != nil {
+		return err
 	}
 	return nil
 }
 
+// parseBody sets the body of the request to a reader that stops at the end
+// of it, the body is not read here, it's up to whoever handles the request
+// to read it (or discard it) before the next request is parsed
+func (r *Request) parseBody() error {
+	te := r.Headers.Values("Transfer-Encoding")
+	cl := r.Headers.Values("Content-Length")
+	if len(te) > 0 {
+		// both of them can be used to smuggle requests
+		if len(cl) > 0 {
+			return ErrInvalidContentLength
+		}
+		if len(te) != 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "chunked") {
+			return ErrUnsupportedEncoding
+		}
+		r.ContentLength = -1
+		r.Body = &chunkedReader{req: r, tr: r.tr}
+		return nil
+	}
+	if len(cl) == 0 {
+		r.ContentLength = 0
+		r.Body = eofReader{}
+		return nil
+	}
+	for _, v := range cl[1:] {
+		if v != cl[0] {
+			return ErrInvalidContentLength
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(cl[0]), 10, 64)
+	if err != nil || n < 0 {
+		return ErrInvalidContentLength
+	}
+	r.ContentLength = n
+	r.Body = io.LimitReader(r.tr.R, n)
+	return nil
+}
+
+// DiscardBody reads whatever is left of the body
+// so that the next request can be parsed
+func (r *Request) DiscardBody() error {
+	if r.Body == nil {
+		return nil
+	}
+	_, err := io.Copy(io.Discard, r.Body)
+	return err
+}
+
+// ExpectsContinue reports whether the client waits for
+// a "100 Continue" response before sending the body
+func (r *Request) ExpectsContinue() bool {
+	return strings.EqualFold(r.Headers.Get("Expect"), "100-continue")
+}
+
+// Wait blocks until the first bytes of the request are received
+func (r *Request) Wait() error {
+	_, err := r.tr.R.Peek(1)
+	return err
+}
+
+// Reset clears the request so that the next one
+// sent on the connection can be parsed
+func (r *Request) Reset() {
+	r.Method = ""
+	r.Uri = ""
+	r.requestURI = ""
+	r.remoteUser = ""
+	r.expect = nil
+	r.HTTPVersionMajor = 0
+	r.HTTPVersionMinor = 0
+	r.Headers = nil
+	r.Body = nil
+	r.ContentLength = 0
+	r.Trailers = nil
+}
+
+// KeepAlive reports whether the connection should be kept open after
+// the response is sent, HTTP/1.1 connections are persistent by default
+// while HTTP/1.0 connections need to ask for it
+func (r *Request) KeepAlive() bool {
+	keepAlive := r.HTTPVersionMajor == 1 && r.HTTPVersionMinor >= 1
+	for _, v := range r.Headers.Values("Connection") {
+		for _, opt := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(opt)) {
+			case "close":
+				return false
+			case "keep-alive":
+				keepAlive = true
+			}
+		}
+	}
+	return keepAlive
+}
+
 func (r *Request) parseRequestLine() error {
-	b, err := r.tr.ReadLineBytes()
+	max := r.maxRequestLine
+	if max <= 0 {
+		max = defaultMaxRequestLine
+	}
+	b, err := r.readLine(max)
+	if err == errLineTooLong {
+		return ErrRequestLineTooLong
+	}
 	if err != nil && err != io.EOF {
 		return err
 	}
@@ -76,6 +197,7 @@ func (r *Request) parseRequestLine() error {
 		return ErrInvalidRequestLine
 	}
 	r.Method, r.Uri = string(line[0]), string(line[1])
+	r.requestURI = r.Uri
 
 	// validate the request method
 	if err = r.validateMethod(); err != nil {
@@ -112,9 +234,11 @@ func (r *Request) parseRequestLine() error {
 	return nil
 }
 
+// parseRequestHeaders reads the lines of the headers before they're parsed,
+// so that a client can't send more of them than what's allowed
 func (r *Request) parseRequestHeaders() error {
-	h, err := r.tr.ReadMIMEHeader()
-	if err != nil && err != io.EOF {
+	h, err := r.readHeaders()
+	if err != nil {
 		return err
 	}
 	// log.Printf("headers read: %v\n", h)
@@ -122,6 +246,97 @@ func (r *Request) parseRequestHeaders() error {
 	return nil
 }
 
+// readHeaders reads header lines until an empty one, they can't be larger
+// than max_header_size or more than max_headers. It's also used for the
+// trailers of a chunked body, which have the same limits
+func (r *Request) readHeaders() (textproto.MIMEHeader, error) {
+	maxSize, maxHeaders := r.maxHeaderSize, r.maxHeaders
+	if maxSize <= 0 {
+		maxSize = defaultMaxHeaderSize
+	}
+	if maxHeaders <= 0 {
+		maxHeaders = defaultMaxHeaders
+	}
+	var buf bytes.Buffer
+	count := 0
+	for {
+		line, err := r.readLine(maxSize - buf.Len())
+		if err == errLineTooLong {
+			return nil, ErrHeadersTooLarge
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 {
+			break
+		}
+		// the lines that start with a space continue the previous header
+		if line[0] != ' ' && line[0] != '\t' {
+			if count++; count > maxHeaders {
+				return nil, ErrHeadersTooLarge
+			}
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+		if err == io.EOF {
+			break
+		}
+	}
+	buf.WriteString("\r\n")
+	h, err := textproto.NewReader(bufio.NewReader(&buf)).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Proto returns the version of the request, like "HTTP/1.1"
+func (r *Request) Proto() string {
+	return "HTTP/" + strconv.Itoa(r.HTTPVersionMajor) + "." + strconv.Itoa(r.HTTPVersionMinor)
+}
+
+// RequestURI returns the uri sent by the client, before it's rewritten
+func (r *Request) RequestURI() string {
+	if r.requestURI == "" {
+		return r.Uri
+	}
+	return r.requestURI
+}
+
+// Path returns the decoded path of the uri
+func (r *Request) Path() string {
+	u, err := url.ParseRequestURI(r.Uri)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// Host returns the name of the host that the request is sent to, without
+// the port, it's taken from the uri when it's in absolute form
+// or from the Host header otherwise
+func (r *Request) Host() (string, error) {
+	if u, err := url.ParseRequestURI(r.Uri); err == nil && u.Host != "" {
+		return u.Hostname(), nil
+	}
+	hosts := r.Headers.Values("Host")
+	if len(hosts) > 1 {
+		return "", ErrInvalidHost
+	}
+	if len(hosts) == 0 || hosts[0] == "" {
+		// the Host header is required since HTTP/1.1
+		if r.HTTPVersionMajor == 1 && r.HTTPVersionMinor >= 1 {
+			return "", ErrInvalidHost
+		}
+		return "", nil
+	}
+	host := hosts[0]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.Trim(host, "[]"), nil
+}
+
 func (r *Request) validateMethod() error {
 	switch r.Method {
 	case RequestMethodGet,
@@ -131,15 +346,10 @@ func (r *Request) validateMethod() error {
 		RequestMethodTrace,
 		RequestMethodOptions,
 		RequestMethodConnect,
-		RequestMethodPatch:
+		RequestMethodPatch,
+		RequestMethodPost:
 		// everything ok, this request method is allowed
 		return nil
-
-	case RequestMethodPost:
-		if r.Body == nil {
-			return ErrRequestBodyRequired
-		}
-		return nil
 	}
 	return ErrInvalidRequestMethod
 }
@@ -167,6 +377,27 @@ func (r *Request) validateHTTPVersion(v string) error {
 	return nil
 }
 
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads a line without its end, it fails with errLineTooLong
+// once the line is longer than max (without reading the rest of it)
+func (r *Request) readLine(max int) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.tr.R.ReadSlice('\n')
+		if len(line)+len(b) > max+2 {
+			return nil, errLineTooLong
+		}
+		line = append(line, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		return line, err
+	}
+}
+
 func NewRequest(r io.Reader) *Request {
 	tr := textproto.NewReader(bufio.NewReaderSize(r, buffSize))
 	return &Request{
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/textproto"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -101,9 +103,235 @@ func TestParsingOfHeaders(t *testing.T) {
 	}
 }
 
+func TestRequestHost(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+		err     error
+	}{
+		{"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", "www.example.com", nil},
+		{"GET / HTTP/1.1\r\nHost: localhost:8021\r\n\r\n", "localhost", nil},
+		{"GET / HTTP/1.1\r\nHost: [::1]:8021\r\n\r\n", "::1", nil},
+		{"GET http://example.com:8080/foo HTTP/1.1\r\nHost: localhost\r\n\r\n", "example.com", nil},
+		{"GET / HTTP/1.0\r\n\r\n", "", nil},
+		{"GET / HTTP/1.1\r\n\r\n", "", ErrInvalidHost},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n", "", ErrInvalidHost},
+	}
+	for _, test := range tests {
+		req := NewRequest(strings.NewReader(test.payload))
+		if err := req.Parse(); err != nil && err != io.EOF {
+			t.Fatalf(err.Error())
+		}
+		host, err := req.Host()
+		if err != test.err {
+			t.Errorf("Host() returned the error %v but want %v\n", err, test.err)
+		}
+		if host != test.want {
+			t.Errorf("Host() returned %s but want %s\n", host, test.want)
+		}
+	}
+}
+
+func TestRequestKeepAlive(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: a.com\r\n\r\n", true},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\nConnection: close\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\nConnection: Upgrade, Close\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", true},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive, close\r\n\r\n", false},
+	}
+	for _, test := range tests {
+		req := NewRequest(strings.NewReader(test.payload))
+		if err := req.Parse(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if req.KeepAlive() != test.want {
+			t.Errorf("KeepAlive() for %q returned %v but want %v\n", test.payload, !test.want, test.want)
+		}
+	}
+}
+
+func TestRequestLimits(t *testing.T) {
+	headers := func(n int) string {
+		var b strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "X-Header-%d: %d\r\n", i, i)
+		}
+		return b.String()
+	}
+	tests := []struct {
+		payload string
+		err     error
+	}{
+		{"GET /" + strings.Repeat("a", 99) + " HTTP/1.1\r\nHost: a.com\r\n\r\n", nil},
+		{"GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: a.com\r\n\r\n", ErrRequestLineTooLong},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\n" + headers(9) + "\r\n", nil},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\n" + headers(10) + "\r\n", ErrHeadersTooLarge},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\nX-Big: " + strings.Repeat("a", 200) + "\r\n\r\n", ErrHeadersTooLarge},
+		// the limit of the size is for all of the headers
+		{"GET / HTTP/1.1\r\nHost: a.com\r\nX-A: " + strings.Repeat("a", 100) + "\r\nX-B: " + strings.Repeat("b", 100) + "\r\n\r\n", ErrHeadersTooLarge},
+	}
+	for _, test := range tests {
+		req := NewRequest(strings.NewReader(test.payload))
+		// "GET " and " HTTP/1.1" take 13 bytes of the line
+		req.maxRequestLine, req.maxHeaderSize, req.maxHeaders = 113, 200, 10
+		if err := req.Parse(); err != test.err {
+			t.Errorf("Parse() for %.40q returned the error %v but want %v\n", test.payload, err, test.err)
+		}
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	payload := "GET /one HTTP/1.1\r\nHost: a.com\r\n\r\n" +
+		"HEAD /two HTTP/1.1\r\nHost: b.com\r\n\r\n" +
+		"GET /three HTTP/1.0\r\n\r\n"
+	want := []struct {
+		method string
+		uri    string
+	}{
+		{"GET", "/one"},
+		{"HEAD", "/two"},
+		{"GET", "/three"},
+	}
+	req := NewRequest(strings.NewReader(payload))
+	for _, w := range want {
+		if err := req.Wait(); err != nil {
+			t.Fatalf("Wait() returned an error: %s", err)
+		}
+		if err := req.Parse(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if req.Method != w.method || req.Uri != w.uri {
+			t.Errorf("pipelined request is %s %s but it should be %s %s", req.Method, req.Uri, w.method, w.uri)
+		}
+		req.Reset()
+	}
+	if err := req.Wait(); err != io.EOF {
+		t.Errorf("Wait() should return io.EOF after the last request, got %v", err)
+	}
+}
+
 func TestParsingOfBody(t *testing.T) {
-	// we probably don't need this anymore
-	t.SkipNow()
+	tests := []struct {
+		payload       string
+		body          string
+		contentLength int64
+		trailers      map[string][]string
+		err           error
+	}{
+		{
+			"GET / HTTP/1.1\r\nHost: a.com\r\n\r\nGET /next HTTP/1.1\r\n",
+			"", 0, nil, nil,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\n\r\nhello, world",
+			"hello", 5, nil, nil,
+		},
+		{
+			"PUT / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			"hello", 5, nil, nil,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"5\r\nhello\r\n7;ext=1\r\n, world\r\n0\r\n\r\nGET /next HTTP/1.1\r\n",
+			"hello, world", -1, map[string][]string{}, nil,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: Chunked\r\n\r\n" +
+				"a\r\n0123456789\r\n0\r\nChecksum: abc\r\nExpires: never\r\n\r\n",
+			"0123456789", -1, map[string][]string{"Checksum": {"abc"}, "Expires": {"never"}}, nil,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhelloX\r\n0\r\n\r\n",
+			"", -1, nil, ErrInvalidChunkedBody,
+		},
+		// the trailers have the same limits as the headers
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"0\r\nChecksum: " + strings.Repeat("a", defaultMaxHeaderSize) + "\r\n\r\n",
+			"", -1, nil, ErrHeadersTooLarge,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"0\r\n" + strings.Repeat("Checksum: abc\r\n", defaultMaxHeaders+1) + "\r\n",
+			"", -1, nil, ErrHeadersTooLarge,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n",
+			"", -1, nil, ErrInvalidChunkedBody,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhel",
+			"", -1, nil, io.ErrUnexpectedEOF,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello",
+			"", 0, nil, ErrInvalidContentLength,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: -5\r\n\r\nhello",
+			"", 0, nil, ErrInvalidContentLength,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\nhello",
+			"", 0, nil, ErrInvalidContentLength,
+		},
+		{
+			"POST / HTTP/1.1\r\nHost: a.com\r\nTransfer-Encoding: gzip\r\n\r\nhello",
+			"", 0, nil, ErrUnsupportedEncoding,
+		},
+	}
+	for i, test := range tests {
+		req := NewRequest(strings.NewReader(test.payload))
+		err := req.Parse()
+		if err == nil {
+			var b []byte
+			b, err = io.ReadAll(req.Body)
+			if err == nil && string(b) != test.body {
+				t.Errorf("body of payload#%d is %q but it should be %q", i+1, string(b), test.body)
+			}
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("payload#%d returned the error %v but want %v", i+1, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if req.ContentLength != test.contentLength {
+			t.Errorf("content length of payload#%d is %d but it should be %d", i+1, req.ContentLength, test.contentLength)
+		}
+		if test.trailers != nil && !reflect.DeepEqual(req.Trailers, textproto.MIMEHeader(test.trailers)) {
+			t.Errorf("trailers of payload#%d are %v but they should be %v", i+1, req.Trailers, test.trailers)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	tests := []struct {
+		body string
+		max  int64
+		err  error
+	}{
+		{"hello", 5, nil},
+		{"hello", 10, nil},
+		{"hello, world", 5, ErrBodyTooLarge},
+		{"", 0, nil},
+	}
+	for _, test := range tests {
+		r := &maxBodyReader{r: strings.NewReader(test.body), n: test.max}
+		b, err := io.ReadAll(r)
+		if err != test.err {
+			t.Errorf("reading %q with a max of %d returned %v but want %v", test.body, test.max, err, test.err)
+		}
+		if int64(len(b)) > test.max {
+			t.Errorf("read %d bytes but the max is %d", len(b), test.max)
+		}
+	}
 }
 
 func loadRequestPayload(payload string) (io.Reader, error) {
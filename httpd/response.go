@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"time"
 )
 
 const (
@@ -160,21 +167,34 @@ func GetStatusCodeMessage(statusCode int) (string, error) {
 	return "", errors.New("status code not found")
 }
 
+// the format of the dates sent in the headers
+const timeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
 type Response struct {
 	HTTPVersionMajor int
 	HTTPVersionMinor int
 	Code             int
 	Message          string
-	Headers          map[string]string
-	Body             []byte
+	Headers          textproto.MIMEHeader
+	Body             io.Reader
+	// the length of the body, -1 when it's unknown
+	// and the body has to be sent in chunks
+	ContentLength int64
+	// bytes of the body that were sent
+	sent int64
+	// the encoding that the body is compressed with while it's sent
+	encoding string
 }
 
-func NewResponse(code int, headers map[string]string, body []byte) *Response {
+func NewResponse(code int, headers textproto.MIMEHeader, body io.Reader, length int64) *Response {
 	msg, err := GetStatusCodeMessage(code)
 	if err != nil {
 		// TODO: handle errors better here :)
 		log.Println(err)
 	}
+	if headers == nil {
+		headers = make(textproto.MIMEHeader)
+	}
 	addDefaultResponseHeaders(headers)
 	res := &Response{
 		HTTPVersionMinor: HTTPVersionMinor,
@@ -183,37 +203,140 @@ func NewResponse(code int, headers map[string]string, body []byte) *Response {
 		Message:          msg,
 		Headers:          headers,
 		Body:             body,
+		ContentLength:    length,
 	}
 	return res
 }
 
-func BuildResponseBytes(res *Response) []byte {
-	resBytes := make([]byte, 0)
-	resBytes = append(resBytes, []byte(fmt.Sprintf("HTTP/%d.%d %d %s\r\n", res.HTTPVersionMajor, res.HTTPVersionMinor, res.Code, res.Message))...)
+// Write sends the status line and the headers of the response, then copies
+// the body from its reader. The body is sent with Content-Length when its
+// length is known and in chunks otherwise, HTTP/1.0 clients don't know
+// about chunks so the end of their body is when the connection is closed.
+// It's never sent for HEAD requests or for responses that can't have one
+func (res *Response) Write(w io.Writer, req *Request) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/%d.%d %d %s\r\n", res.HTTPVersionMajor, res.HTTPVersionMinor, res.Code, res.Message)
 
-	for k, v := range res.Headers {
-		resBytes = append(resBytes, []byte(fmt.Sprintf("%s: %s\r\n", k, v))...)
+	hasBody := res.hasBody()
+	head := req != nil && req.Method == RequestMethodHead
+	chunked := false
+	if hasBody {
+		if res.ContentLength >= 0 {
+			res.Headers.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+		} else if res.Headers.Get("Content-Length") == "" && !head && !isHTTP10(req) {
+			chunked = true
+			res.Headers.Set("Transfer-Encoding", "chunked")
+		}
 	}
-	resBytes = append(resBytes, []byte("\r\n")...)
-	resBytes = append(resBytes, res.Body...)
-	return resBytes
+	if res.Code >= StatusOk {
+		res.Headers.Set("Date", time.Now().UTC().Format(timeFormat))
+	}
+	keys := make([]string, 0, len(res.Headers))
+	for k := range res.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range res.Headers[k] {
+			fmt.Fprintf(bw, "%s: %s\r\n", k, v)
+		}
+	}
+	bw.WriteString("\r\n")
+
+	if !hasBody || res.Body == nil || head {
+		return bw.Flush()
+	}
+	var err error
+	if chunked {
+		cw := &chunkedWriter{bw}
+		if res.encoding != "" {
+			err = res.writeCompressed(cw)
+		} else {
+			res.sent, err = io.Copy(cw, res.Body)
+		}
+		if err == nil {
+			err = cw.Close()
+		}
+	} else if res.ContentLength >= 0 {
+		res.sent, err = io.CopyN(bw, res.Body, res.ContentLength)
+	} else {
+		res.sent, err = io.Copy(bw, res.Body)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
 }
 
-func SendErrorResponse(code int, msg string) *Response {
-	headers := make(map[string]string)
-	addDefaultResponseHeaders(headers)
-	headers["Content-Type"] = "text/html"
-	headers["Connection"] = "close"
-	return &Response{
-		HTTPVersionMajor: HTTPVersionMinor,
-		HTTPVersionMinor: HTTPVersionMajor,
-		Code:             code,
-		Message:          msg,
-		Headers:          headers,
-		Body:             []byte(fmt.Sprintf("%d %s", code, msg)),
+// writeCompressed compresses the body while it's written to w,
+// the bytes sent are the compressed ones
+func (res *Response) writeCompressed(w io.Writer) error {
+	cw := &countWriter{w: w}
+	zw := newCompressor(res.encoding, cw)
+	_, err := io.Copy(zw, res.Body)
+	if err == nil {
+		err = zw.Close()
 	}
+	res.sent = cw.n
+	return err
+}
+
+func isHTTP10(req *Request) bool {
+	return req != nil && req.HTTPVersionMajor == 1 && req.HTTPVersionMinor == 0
+}
+
+// hasBody reports whether the response can have a body,
+// informational, 204 and 304 responses never have one
+func (res *Response) hasBody() bool {
+	if res.Code < StatusOk {
+		return false
+	}
+	return res.Code != StatusNoContent && res.Code != StatusNotModified
+}
+
+// chunkedWriter sends the data written to it with "Transfer-Encoding: chunked"
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		// an empty chunk would end the body
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(c.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(c.w, "\r\n")
+	return n, err
+}
+
+// Close sends the last chunk
+func (c *chunkedWriter) Close() error {
+	_, err := io.WriteString(c.w, "0\r\n\r\n")
+	return err
+}
+
+func SendErrorResponse(code int, msg string) *Response {
+	headers := make(textproto.MIMEHeader)
+	headers.Set("Content-Type", "text/html")
+	body := []byte(fmt.Sprintf("%d %s", code, msg))
+	res := NewResponse(code, headers, bytes.NewReader(body), int64(len(body)))
+	res.Message = msg
+	return res
+}
+
+// redirectResponse returns a response that redirects the client to the location
+func redirectResponse(code int, location string) *Response {
+	res := SendErrorResponse(code, statusCodes[code])
+	res.Headers.Set("Location", location)
+	return res
 }
 
-func addDefaultResponseHeaders(headers map[string]string) {
-	headers["Server"] = "httpd v" + Version
+func addDefaultResponseHeaders(headers textproto.MIMEHeader) {
+	headers.Set("Server", "httpd v"+Version)
 }
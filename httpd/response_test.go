@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseWrite(t *testing.T) {
+	tests := []struct {
+		method        string
+		code          int
+		body          string
+		length        int64
+		wantBody      string
+		contentLength string
+		chunked       bool
+		minor         int
+	}{
+		{"GET", 200, "Hello, world", 12, "Hello, world", "12", false, 1},
+		{"GET", 200, "Hello, world", -1, "Hello, world", "", true, 1},
+		{"GET", 200, "", -1, "", "", true, 1},
+		{"HEAD", 200, "Hello, world", 12, "", "12", false, 1},
+		{"HEAD", 200, "Hello, world", -1, "", "", false, 1},
+		{"GET", 204, "Hello, world", 12, "", "", false, 1},
+		{"GET", 304, "Hello, world", 12, "", "", false, 1},
+		// the body ends when the connection is closed
+		{"GET", 200, "Hello, world", -1, "Hello, world", "", false, 0},
+		{"GET", 200, "Hello, world", 12, "Hello, world", "12", false, 0},
+		{"HEAD", 200, "Hello, world", -1, "", "", false, 0},
+	}
+	for i, test := range tests {
+		req := &Request{Method: test.method, HTTPVersionMajor: 1, HTTPVersionMinor: test.minor}
+		res := NewResponse(test.code, nil, strings.NewReader(test.body), test.length)
+		var buf bytes.Buffer
+		if err := res.Write(&buf, req); err != nil {
+			t.Fatalf("response#%d could not be written: %s", i+1, err)
+		}
+		raw := buf.String()
+		r := bufio.NewReader(&buf)
+		httpRes, err := http.ReadResponse(r, &http.Request{Method: test.method})
+		if err != nil {
+			t.Fatalf("response#%d is not valid: %s\n%s", i+1, err, raw)
+		}
+		b, err := io.ReadAll(httpRes.Body)
+		if err != nil {
+			t.Fatalf("error reading the body of response#%d: %s", i+1, err)
+		}
+		if httpRes.StatusCode != test.code {
+			t.Errorf("response#%d has the code %d but want %d", i+1, httpRes.StatusCode, test.code)
+		}
+		if string(b) != test.wantBody {
+			t.Errorf("response#%d has the body %q but want %q", i+1, string(b), test.wantBody)
+		}
+		if cl := httpRes.Header.Get("Content-Length"); cl != test.contentLength {
+			t.Errorf("response#%d has the Content-Length %q but want %q", i+1, cl, test.contentLength)
+		}
+		chunked := len(httpRes.TransferEncoding) > 0 && httpRes.TransferEncoding[0] == "chunked"
+		if chunked != test.chunked {
+			t.Errorf("response#%d chunked is %v but want %v\n%s", i+1, chunked, test.chunked, raw)
+		}
+		if _, err := time.Parse(timeFormat, httpRes.Header.Get("Date")); err != nil {
+			t.Errorf("response#%d has an invalid Date header: %s", i+1, err)
+		}
+		if r.Buffered() != 0 {
+			t.Errorf("response#%d has extra data after the body:\n%s", i+1, raw)
+		}
+	}
+}
+
+func TestChunkedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	cw := &chunkedWriter{&buf}
+	for _, s := range []string{"Hello", "", ", world!"} {
+		if _, err := io.WriteString(cw, s); err != nil {
+			t.Fatalf("error writing chunk: %s", err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("error writing the last chunk: %s", err)
+	}
+	want := "5\r\nHello\r\n8\r\n, world!\r\n0\r\n\r\n"
+	if buf.String() != want {
+		t.Errorf("chunked data is %q but want %q", buf.String(), want)
+	}
+}
+
+func TestErrorResponseHeaders(t *testing.T) {
+	res := SendErrorResponse(StatusNotFound, "Not Found")
+	if res.Headers.Get("Server") != "httpd v"+Version {
+		t.Errorf("the Server header is missing")
+	}
+	if res.ContentLength != int64(len("404 Not Found")) {
+		t.Errorf("the length of the body is %d but want %d", res.ContentLength, len("404 Not Found"))
+	}
+	if _, ok := res.Headers[textproto.CanonicalMIMEHeaderKey("Connection")]; ok {
+		t.Errorf("error responses should not set the Connection header")
+	}
+}
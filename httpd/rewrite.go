@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rewrite and return options, the ones of the server run first and then
+// the ones of the location that matches the uri. A rewrite changes the uri
+// of the request (or redirects it) and a return sends a response right away
+
+const (
+	rewriteLast      = "last"
+	rewriteBreak     = "break"
+	rewriteRedirect  = "redirect"
+	rewritePermanent = "permanent"
+)
+
+// how many times the location can be searched again after a rewrite
+const maxRewriteCycles = 10
+
+var ErrRewriteCycle = errors.New("rewrite cycle")
+
+// Rewrite is a rewrite or a return option, they run in the
+// order that they have in the configuration
+type Rewrite struct {
+	// the regex that the path must match, empty for a return
+	Pattern     string
+	Replacement string
+	// one of the rewrite flags, empty when there's none
+	Flag string
+	// the status code of a return, 0 for a rewrite
+	Code int
+	re   *regexp.Regexp
+}
+
+// parseRewrite parses "regex replacement [flag]"
+func parseRewrite(value string) (Rewrite, error) {
+	var r Rewrite
+	fields := strings.Fields(value)
+	if len(fields) < 2 || len(fields) > 3 {
+		return r, errors.New("expected a regex, a replacement and an optional flag")
+	}
+	r.Pattern, r.Replacement = fields[0], fields[1]
+	if len(fields) == 3 {
+		r.Flag = fields[2]
+		switch r.Flag {
+		case rewriteLast, rewriteBreak, rewriteRedirect, rewritePermanent:
+		default:
+			return r, fmt.Errorf("unknown flag %q", r.Flag)
+		}
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return r, fmt.Errorf("invalid regex %q: %s", r.Pattern, err)
+	}
+	r.re = re
+	return r, nil
+}
+
+// parseReturn parses "code [text or url]" or a single url that is a
+// redirect with 302, the url is required for the redirect codes
+func parseReturn(value string) (Rewrite, error) {
+	r := Rewrite{Code: StatusFound, Replacement: value}
+	fields := strings.SplitN(value, " ", 2)
+	if code, err := strconv.Atoi(fields[0]); err == nil {
+		if code < StatusOk || code > 599 {
+			return r, fmt.Errorf("invalid status code %d", code)
+		}
+		r.Code, r.Replacement = code, ""
+		if len(fields) == 2 {
+			r.Replacement = strings.TrimSpace(fields[1])
+		}
+	} else if !isRedirectURL(value) {
+		return r, fmt.Errorf("%q is not a status code or a url", fields[0])
+	}
+	if isRedirectCode(r.Code) && r.Replacement == "" {
+		return r, fmt.Errorf("a redirect with %d needs a url", r.Code)
+	}
+	return r, nil
+}
+
+func isRedirectCode(code int) bool {
+	switch code {
+	case StatusMovedPermanently, StatusFound, StatusSeeOther, StatusTemporaryRedirect, StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// isRedirectURL reports whether a replacement redirects
+// the client instead of changing the uri
+func isRedirectURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "$scheme")
+}
+
+// rewriteRequest runs the rewrites of the server and the ones of the location
+// that matches the uri, the location is searched again when its rewrites
+// change the uri. It returns the configuration to use for the request and
+// the response of a return or a redirect
+func rewriteRequest(req *Request, srv *ServerConf) (*ServerConf, *Response, error) {
+	// a last or a break only stop the rewrites of the server
+	if res, _ := runRewrites(req, srv, srv.Rewrites); res != nil {
+		return srv, res, nil
+	}
+	for i := 0; i < maxRewriteCycles; i++ {
+		loc := srv.findLocation(locationPath(req))
+		if loc == srv {
+			return srv, nil, nil
+		}
+		res, again := runRewrites(req, loc, loc.Rewrites)
+		if res != nil || !again {
+			return loc, res, nil
+		}
+	}
+	return srv, nil, ErrRewriteCycle
+}
+
+// runRewrites runs the rules in order until a return, a redirect or a rewrite
+// with a flag that stops them, again is true when the location has to be
+// searched again for the new uri
+func runRewrites(req *Request, srv *ServerConf, rules []Rewrite) (res *Response, again bool) {
+	changed := false
+	for _, r := range rules {
+		if r.Code != 0 {
+			return returnResponse(req, srv, r), false
+		}
+		m := r.re.FindStringSubmatch(req.Path())
+		if m == nil {
+			continue
+		}
+		target := expandVars(r.Replacement, func(name string) (string, bool) {
+			if n, err := strconv.Atoi(name); err == nil {
+				if n < len(m) {
+					return m[n], true
+				}
+				return "", true
+			}
+			return requestVar(req, name)
+		})
+		target = appendArgs(target, req)
+		switch {
+		case r.Flag == rewritePermanent:
+			return redirectResponse(StatusMovedPermanently, target), false
+		case r.Flag == rewriteRedirect || isRedirectURL(target):
+			return redirectResponse(StatusFound, target), false
+		}
+		req.Uri = escapeURI(target)
+		changed = true
+		switch r.Flag {
+		case rewriteLast:
+			return nil, true
+		case rewriteBreak:
+			return nil, false
+		}
+	}
+	return nil, changed
+}
+
+// appendArgs adds the query of the request to the replacement, a
+// replacement that ends with "?" doesn't keep the query of the request
+func appendArgs(target string, req *Request) string {
+	if strings.HasSuffix(target, "?") {
+		return strings.TrimSuffix(target, "?")
+	}
+	args, _ := requestVar(req, "args")
+	if args == "" {
+		return target
+	}
+	if strings.Contains(target, "?") {
+		return target + "&" + args
+	}
+	return target + "?" + args
+}
+
+// escapeURI escapes the path of a uri that was built from the decoded path
+func escapeURI(uri string) string {
+	p, query, hasQuery := strings.Cut(uri, "?")
+	uri = (&url.URL{Path: p}).EscapedPath()
+	if hasQuery {
+		uri += "?" + query
+	}
+	return uri
+}
+
+// returnResponse returns the response of a return option, the redirects
+// have the url in the Location header and the other codes send the text
+// as the body (or the error page for the code when there's none)
+func returnResponse(req *Request, srv *ServerConf, r Rewrite) *Response {
+	value := expandVars(r.Replacement, func(name string) (string, bool) {
+		return requestVar(req, name)
+	})
+	if isRedirectCode(r.Code) {
+		return redirectResponse(r.Code, value)
+	}
+	if value == "" && r.Code >= StatusBadRequest {
+		return errorResponse(srv, r.Code)
+	}
+	headers := make(textproto.MIMEHeader)
+	headers.Set("Content-Type", "text/plain; charset=utf-8")
+	return NewResponse(r.Code, headers, bytes.NewReader([]byte(value)), int64(len(value)))
+}
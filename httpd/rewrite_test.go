@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io"
+	"net/textproto"
+	"testing"
+)
+
+func TestRewriteRequest(t *testing.T) {
+	conf, err := buildServerConf([]byte(`root = /var/www
+rewrite = ^/old/(.*)$ /new/$1
+rewrite = ^/moved/(.*)$ https://$host/$1 permanent
+rewrite = ^/temp$ /new/temp redirect
+location /new/ {
+    root = /var/www/new
+    rewrite = ^/new/blog/(\d+)$ /posts/$1? last
+    rewrite = ^/new/stop$ /stopped break
+}
+location /posts/ {
+    root = /var/www/posts
+}
+location = /gone {
+    return = 410
+}
+location = /text {
+    return = 200 hello from $host
+}
+location = /home {
+    return = 301 $scheme://$host/
+}
+location /loop/ {
+    rewrite = ^/loop/(.*)$ /loop/$1 last
+}
+`))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	tests := []struct {
+		uri  string
+		want string
+		root string
+		code int
+		body string
+		// the Location header of a redirect
+		location string
+	}{
+		{uri: "/index.html", want: "/index.html", root: "/var/www"},
+		{uri: "/old/a%20b.html?x=1", want: "/new/a%20b.html?x=1", root: "/var/www/new"},
+		{uri: "/old/blog/12?x=1", want: "/posts/12", root: "/var/www/posts"},
+		{uri: "/new/stop", want: "/stopped", root: "/var/www/new"},
+		{uri: "/moved/a?b=c", code: StatusMovedPermanently, location: "https://example.com/a?b=c"},
+		{uri: "/temp", code: StatusFound, location: "/new/temp"},
+		{uri: "/gone", code: StatusGone},
+		{uri: "/text", code: StatusOk, body: "hello from example.com"},
+		{uri: "/home", code: StatusMovedPermanently, location: "http://example.com/"},
+	}
+	for _, test := range tests {
+		req := &Request{
+			Method:     "GET",
+			Uri:        test.uri,
+			requestURI: test.uri,
+			Headers:    textproto.MIMEHeader{"Host": {"example.com"}},
+		}
+		srv, res, err := rewriteRequest(req, conf.DefaultServer)
+		if err != nil {
+			t.Errorf("rewriteRequest(%s) failed: %s", test.uri, err)
+			continue
+		}
+		if test.code == 0 {
+			if res != nil {
+				t.Errorf("rewriteRequest(%s) returned a response with %d", test.uri, res.Code)
+			}
+			if req.Uri != test.want {
+				t.Errorf("rewriteRequest(%s) changed the uri to %s but want %s", test.uri, req.Uri, test.want)
+			}
+			if srv.Root != test.root {
+				t.Errorf("rewriteRequest(%s) returned the root %s but want %s", test.uri, srv.Root, test.root)
+			}
+			if req.RequestURI() != test.uri {
+				t.Errorf("the original uri should be kept, got %s", req.RequestURI())
+			}
+			continue
+		}
+		if res == nil {
+			t.Errorf("rewriteRequest(%s) should return a response with %d", test.uri, test.code)
+			continue
+		}
+		if res.Code != test.code {
+			t.Errorf("rewriteRequest(%s) returned %d but want %d", test.uri, res.Code, test.code)
+		}
+		if got := res.Headers.Get("Location"); got != test.location {
+			t.Errorf("rewriteRequest(%s) redirected to %q but want %q", test.uri, got, test.location)
+		}
+		if test.body != "" {
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != test.body {
+				t.Errorf("rewriteRequest(%s) returned %q but want %q", test.uri, body, test.body)
+			}
+		}
+	}
+	req := &Request{Method: "GET", Uri: "/loop/a", Headers: textproto.MIMEHeader{}}
+	if _, _, err := rewriteRequest(req, conf.DefaultServer); err != ErrRewriteCycle {
+		t.Errorf("a rewrite that always matches should fail with %s, got %v", ErrRewriteCycle, err)
+	}
+}
+
+func TestParseReturn(t *testing.T) {
+	tests := []struct {
+		value string
+		code  int
+		ok    bool
+	}{
+		{"301 https://example.com$request_uri", StatusMovedPermanently, true},
+		{"https://example.com/", StatusFound, true},
+		{"404", StatusNotFound, true},
+		{"200 ok", StatusOk, true},
+		{"301", 0, false},
+		{"999 text", 0, false},
+		{"/relative", 0, false},
+	}
+	for _, test := range tests {
+		r, err := parseReturn(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("parseReturn(%q) returned the error %v", test.value, err)
+			continue
+		}
+		if test.ok && r.Code != test.code {
+			t.Errorf("parseReturn(%q) returned %d but want %d", test.value, r.Code, test.code)
+		}
+	}
+}
@@ -1,101 +1,760 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/textproto"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // starts the server process and handles every request sent to it
 // handles server start, restart and shutdown
 
-func Start(conf *Conf) error {
+const defaultShutdownTimeout = 30 * time.Second
+
+// how long a connection that is closed by the server
+// keeps reading whatever the client is still sending
+const lingerTimeout = 2 * time.Second
+
+var ErrShutdownTimeout = errors.New("shutdown timed out, connections were closed")
+
+type Server struct {
+	conf         atomic.Pointer[Conf]
+	certs        atomic.Pointer[certificates]
+	upstreams    atomic.Pointer[upstreams]
+	limits       *limits
+	auth         *authFiles
+	creds        credentials
+	logs         *Logs
+	mu           sync.Mutex
+	listeners    map[int]*listener
+	inherited    map[int]net.Listener // opened by the master or the old binary
+	upgraded     *os.File             // tells the old binary that the server is listening
+	conns        map[net.Conn]bool    // true when the connection is idle
+	connsWg      sync.WaitGroup
+	shuttingDown bool
+	done         chan struct{}
+}
+
+// listener accepts the connections of a single port
+type listener struct {
+	port int
+	tls  bool
+	l    net.Listener
+	raw  net.Listener // without tls
+	wg   sync.WaitGroup
+}
+
+func NewServer(conf *Conf) *Server {
+	s := &Server{
+		listeners: make(map[int]*listener),
+		conns:     make(map[net.Conn]bool),
+		done:      make(chan struct{}),
+		limits:    newLimits(),
+		auth:      newAuthFiles(),
+		creds:     osCredentials{},
+		logs:      NewLogs(),
+	}
+	s.conf.Store(conf)
+	return s
+}
+
+// Start starts listening on every port of the configuration
+// and blocks until the server is shutdown
+func (s *Server) Start() error {
+	conf := s.conf.Load()
 	ports, err := getPortsToListen(conf)
 	if err != nil {
 		return err
 	}
-	var wg sync.WaitGroup
-	for _, p := range ports {
-		wg.Add(1)
-		go func(port int) {
-			defer wg.Done()
-			l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-			if err != nil {
-				log.Print(err)
+	certs, err := loadCertificates(conf)
+	if err != nil {
+		return err
+	}
+	s.certs.Store(&certs)
+	ups := buildUpstreams(conf, nil)
+	s.upstreams.Store(&ups)
+	if err := s.logs.Open(conf); err != nil {
+		return err
+	}
+	defer s.logs.Close()
+	s.mu.Lock()
+	for _, port := range ports {
+		if err := s.listen(port, conf); err != nil {
+			log.Print(err)
+		}
+	}
+	for port, l := range s.inherited {
+		l.Close()
+		delete(s.inherited, port)
+	}
+	listening := len(s.listeners)
+	// the connections are not handled until s.mu is unlocked,
+	// so none of them are handled with the privileges of root
+	err = nil
+	if listening > 0 {
+		err = dropPrivileges(s.creds, conf)
+	}
+	s.mu.Unlock()
+	if listening == 0 {
+		return errors.New("could not listen on any port")
+	}
+	if err != nil {
+		return err
+	}
+	notifyUpgrade(s.upgraded)
+	<-s.done
+	return nil
+}
+
+// listen opens a listener on the port (or uses the one of the master) and
+// starts the goroutine that accepts its connections, s.mu must be held
+func (s *Server) listen(port int, conf *Conf) error {
+	l, ok := s.inherited[port]
+	if ok {
+		delete(s.inherited, port)
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+			return err
+		}
+	}
+	lis := &listener{port: port, l: l, raw: l}
+	if tlsPorts(conf)[port] {
+		lis.tls = true
+		lis.l = tls.NewListener(l, s.tlsConfig(port))
+		log.Printf("listening on %d (tls)", port)
+	} else {
+		log.Printf("listening on %d", port)
+	}
+	lis.wg.Add(1)
+	go s.accept(lis)
+	s.listeners[port] = lis
+	return nil
+}
+
+func (s *Server) accept(lis *listener) {
+	defer lis.wg.Done()
+	for {
+		conn, err := lis.l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
 				return
 			}
-			log.Printf("goroutine listening on %d", port)
-			var lwg sync.WaitGroup
-			for i := 0; i < conf.Workers; i++ {
-				lwg.Add(1)
-				go func(l net.Listener) {
-					defer lwg.Done()
-					for {
-						conn, err := l.Accept()
-						if err != nil {
-							log.Print(err)
-							continue
-						}
-						go handleConn(conn)
-					}
-				}(l)
+			log.Print(err)
+			continue
+		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return
+		}
+		go s.handleConn(conn, lis.port)
+	}
+}
+
+// trackConn adds the connection to the active ones, it
+// fails if the server is already shutting down
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = true
+	s.connsWg.Add(1)
+	return true
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// setIdle marks the connection as idle (waiting for a request) or busy, idle
+// connections are closed on shutdown, it fails if the server is shutting down
+func (s *Server) setIdle(conn net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = idle
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.connsWg.Done()
+}
+
+// Shutdown stops accepting new connections and waits for the active ones
+// to finish, the connections that are still open after the configured
+// timeout are closed
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.shuttingDown = true
+	for port, lis := range s.listeners {
+		lis.l.Close()
+		delete(s.listeners, port)
+	}
+	// nothing is lost by closing the connections
+	// that are waiting for their next request
+	for conn, idle := range s.conns {
+		if idle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	defer close(s.done)
+
+	timeout := s.conf.Load().shutdownTimeout()
+	drained := make(chan struct{})
+	go func() {
+		s.connsWg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(timeout):
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-drained
+		return ErrShutdownTimeout
+	}
+}
+
+// Reload swaps the configuration of the server, listeners are opened
+// for the new ports and closed for the ones that are not used anymore,
+// the connections that are already open are not dropped
+func (s *Server) Reload(conf *Conf) error {
+	ports, err := getPortsToListen(conf)
+	if err != nil {
+		return err
+	}
+	certs, err := loadCertificates(conf)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return errors.New("server is shutting down")
+	}
+	if err := s.logs.Open(conf); err != nil {
+		return err
+	}
+	s.certs.Store(&certs)
+	ups := buildUpstreams(conf, *s.upstreams.Load())
+	s.upstreams.Store(&ups)
+	s.conf.Store(conf)
+	newPorts := make(map[int]bool)
+	useTLS := tlsPorts(conf)
+	for _, port := range ports {
+		newPorts[port] = true
+		if lis, ok := s.listeners[port]; ok {
+			if lis.tls == useTLS[port] {
+				continue
 			}
-			lwg.Wait()
-			l.Close()
-			log.Printf("goroutine done")
-		}(p)
+			// the port was switched from or to tls
+			lis.l.Close()
+			delete(s.listeners, port)
+		}
+		if err := s.listen(port, conf); err != nil {
+			log.Print(err)
+		}
+	}
+	for port, lis := range s.listeners {
+		if !newPorts[port] {
+			lis.l.Close()
+			delete(s.listeners, port)
+			log.Printf("stopped listening on %d", port)
+		}
 	}
-	wg.Wait()
 	return nil
 }
 
-func handleConn(conn net.Conn) {
+// Upgrade starts the new binary with the listeners of the server,
+// once it returns the new binary is listening too and the server
+// should be shut down
+func (s *Server) Upgrade() error {
+	s.mu.Lock()
+	files := make(map[int]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for port, lis := range s.listeners {
+		tl, ok := lis.raw.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		files[port] = f
+	}
+	s.mu.Unlock()
+	if len(files) == 0 {
+		return errors.New("the server is not listening on any port")
+	}
+	return upgrade(files)
+}
+
+// ReopenLogs reopens the access and error logs of every server
+func (s *Server) ReopenLogs() error {
+	return s.logs.Reopen()
+}
+
+// handleConn reads every request sent on the connection, the connection
+// is kept open between requests unless the client (or the server) asks for it
+// to be closed, it's closed after being idle for the keep-alive timeout
+func (s *Server) handleConn(conn net.Conn, port int) {
+	defer s.untrackConn(conn)
+	defer closeConn(conn)
+	_, isTLS := conn.(*tls.Conn)
+	cc := &clientConn{Conn: conn}
+	req := NewRequest(cc)
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.TLS = isTLS
+	// the idle connections and the ones that are still sending
+	// their request count too, one client can't have too many
+	conf := s.conf.Load()
+	release, ok := s.limits.openConn(req.RemoteAddr, connLimit(conf, port))
+	if !ok {
+		s.logs.Errorf(conf.DefaultServer, LogInfo, "too many connections from %s", req.RemoteAddr)
+		sendResponse(cc, nil, tooManyRequestsResponse(nil, limitConnRetryAfter), false)
+		return
+	}
+	defer release()
+	for served := 1; ; served++ {
+		conf := s.conf.Load()
+		cc.readTimeout, cc.writeTimeout = 0, conf.writeTimeout()
+		conn.SetReadDeadline(time.Now().Add(conf.keepAliveTimeout()))
+		if err := req.Wait(); err != nil {
+			// closed by the client or idle for too long
+			return
+		}
+		if !s.setIdle(conn, false) {
+			return
+		}
+		// the request line and the headers have to be sent in time,
+		// it doesn't matter how slowly they're sent
+		conn.SetReadDeadline(time.Now().Add(conf.headerTimeout()))
+		req.maxRequestLine, req.maxHeaderSize, req.maxHeaders = conf.maxRequestLine(), conf.maxHeaderSize(), conf.maxHeaders()
+		err := req.Parse()
+		if err != nil {
+			s.logs.Errorf(conf.DefaultServer, LogInfo, "invalid request from %s: %s", req.RemoteAddr, err)
+			sendResponse(cc, nil, errorResponse(nil, parseErrorCode(err)), false)
+			return
+		}
+		cc.readTimeout = conf.bodyTimeout()
+		keepAlive := req.KeepAlive() && served < conf.keepAliveRequests() && !s.isShuttingDown()
+		if !s.serveRequest(cc, req, conf, port, keepAlive) {
+			return
+		}
+		// whatever is left of the body is not part of the next request
+		if err := req.DiscardBody(); err != nil {
+			return
+		}
+		req.Reset()
+		if !s.setIdle(conn, true) {
+			return
+		}
+	}
+}
+
+// closeConn closes the connection without losing the last response, the
+// data that the client is still sending (like a rejected body) is read for
+// a little while, otherwise closing the socket with unread data resets the
+// connection and the client may never get the response
+func closeConn(conn net.Conn) {
 	defer conn.Close()
-	req := NewRequest(conn)
-	err := req.Parse()
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok || cw.CloseWrite() != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.Copy(io.Discard, conn)
+}
+
+// serveRequest sends the response of the request and logs it, it
+// returns whether the connection can be used for the next request
+func (s *Server) serveRequest(conn net.Conn, req *Request, conf *Conf, port int, keepAlive bool) bool {
+	start := time.Now()
+	srv, res, keepAlive := s.handleRequest(conn, req, conf, port, keepAlive)
+	compressResponse(req, srv, res)
+	keepAlive = sendResponse(conn, req, res, keepAlive)
+	s.logs.Access(srv, req, res, start)
+	return keepAlive
+}
+
+// handleRequest returns the response for the request and the server that
+// handled it, it also returns whether the connection can be kept open
+func (s *Server) handleRequest(conn net.Conn, req *Request, conf *Conf, port int, keepAlive bool) (*ServerConf, *Response, bool) {
+	host, err := req.Host()
+	if err != nil {
+		s.logs.Errorf(conf.DefaultServer, LogInfo, "invalid host for %s %s", req.Method, req.Uri)
+		return conf.DefaultServer, errorResponse(nil, StatusBadRequest), false
+	}
+	srv := findServer(conf, port, host)
+	if srv == nil {
+		return nil, errorResponse(nil, StatusNotFound), keepAlive
+	}
+	srv, res, err := rewriteRequest(req, srv)
 	if err != nil {
-		// TODO: FIX!
-		if errors.Is(err, ErrInvalidRequestLine) {
-			writeErrResponse(conn, StatusBadRequest)
-		} else {
-			writeErrResponse(conn, StatusInternalServerError)
+		s.logs.Errorf(srv, LogError, "error rewriting %s %s: %s", req.Method, req.RequestURI(), err)
+		return srv, errorResponse(srv, StatusInternalServerError), false
+	}
+	if code := prepareBody(conn, req, srv); code != 0 {
+		s.logs.Errorf(srv, LogInfo, "body of %s %s rejected with %d", req.Method, req.Uri, code)
+		return srv, errorResponse(srv, code), false
+	}
+	if res != nil {
+		// a return or a redirect doesn't use the body
+		if err := req.DiscardBody(); err != nil {
+			return srv, errorResponse(srv, bodyErrorCode(err)), false
 		}
-		return
+		return srv, res, keepAlive
 	}
+	if s.limits.tooManyConns(srv, req.RemoteAddr) {
+		s.logs.Errorf(srv, LogInfo, "too many connections from %s for %s %s", req.RemoteAddr, req.Method, req.Uri)
+		// closing the connection is what the client needs to do
+		return srv, tooManyRequestsResponse(srv, limitConnRetryAfter), false
+	}
+	retryAfter, ok := s.limits.acquire(srv, req.RemoteAddr)
+	if !ok {
+		s.logs.Errorf(srv, LogInfo, "too many requests from %s for %s %s", req.RemoteAddr, req.Method, req.Uri)
+		// the body is not read, the connection can only be kept open without one
+		return srv, tooManyRequestsResponse(srv, retryAfter), keepAlive && req.ContentLength == 0
+	}
+	return s.handleLocation(conn, req, srv, host, port, keepAlive)
+}
 
-	code, headers, body, err := processRequest(req)
+// handleLocation returns the response for a request that is
+// handled by the server (or one of its locations)
+func (s *Server) handleLocation(conn net.Conn, req *Request, srv *ServerConf, host string, port int, keepAlive bool) (*ServerConf, *Response, bool) {
+	if !srv.methodAllowed(req.Method) {
+		s.logs.Errorf(srv, LogInfo, "method %s is not allowed for %s", req.Method, req.Uri)
+		res := errorResponse(srv, StatusMethodNotAllowed)
+		res.Headers.Set("Allow", strings.Join(srv.Methods, ", "))
+		return srv, res, keepAlive
+	}
+	if !req.TLS && srv.redirectsToHTTPS() {
+		return srv, httpsRedirectResponse(srv, host, req), keepAlive
+	}
+	if srv.authBasic() {
+		user, err := s.auth.authenticate(req, srv)
+		if err != nil {
+			s.logs.Errorf(srv, LogError, "error reading the users of %s %s: %s", req.Method, req.Uri, err)
+			return srv, errorResponse(srv, StatusInternalServerError), false
+		}
+		if user == "" {
+			s.logs.Errorf(srv, LogInfo, "%s %s: no valid user and password from %s", req.Method, req.Uri, req.RemoteAddr)
+			// the client sends the request again with the password
+			if err := req.DiscardBody(); err != nil {
+				return srv, unauthorizedResponse(srv), false
+			}
+			return srv, unauthorizedResponse(srv), keepAlive
+		}
+		req.remoteUser = user
+	}
+	if srv.FastCGIPass != "" {
+		if script, pathInfo, ok := fastcgiScript(req, srv); ok {
+			return s.handleFastCGI(conn, req, srv, port, script, pathInfo, keepAlive)
+		}
+	}
+	if srv.ProxyPass != "" {
+		return s.handleProxy(req, srv, keepAlive)
+	}
+	// the static files don't use the body of the request
+	if err := req.DiscardBody(); err != nil {
+		s.logs.Errorf(srv, LogInfo, "error reading the body of %s %s: %s", req.Method, req.Uri, err)
+		return srv, errorResponse(srv, bodyErrorCode(err)), false
+	}
+	res, err := processRequest(req, srv)
 	if err != nil {
-		writeErrResponse(conn, StatusInternalServerError)
-		return
+		s.logs.Errorf(srv, LogError, "error processing %s %s: %s", req.Method, req.Uri, err)
+		return srv, errorResponse(srv, StatusInternalServerError), false
 	}
+	if res.Code >= StatusBadRequest {
+		msg, _ := GetStatusCodeMessage(res.Code)
+		s.logs.Errorf(srv, LogInfo, "%s %s: %s", req.Method, req.Uri, msg)
+		errRes := errorResponse(srv, res.Code)
+		// a 416 tells the size of the file
+		if cr := res.Headers.Get("Content-Range"); cr != "" {
+			errRes.Headers.Set("Content-Range", cr)
+		}
+		return srv, errRes, keepAlive
+	}
+	return srv, res, keepAlive
+}
 
-	res := NewResponse(code, headers, body)
-	_, err = conn.Write(BuildResponseBytes(res))
+// handleFastCGI returns the response of the fastcgi backend for the script
+func (s *Server) handleFastCGI(conn net.Conn, req *Request, srv *ServerConf, port int, script, pathInfo string, keepAlive bool) (*ServerConf, *Response, bool) {
+	if err := bufferBody(req); err != nil {
+		s.logs.Errorf(srv, LogInfo, "error reading the body of %s %s: %s", req.Method, req.Uri, err)
+		return srv, errorResponse(srv, bodyErrorCode(err)), false
+	}
+	res, err := s.fastcgiResponse(conn, req, srv, port, script, pathInfo)
 	if err != nil {
-		writeErrResponse(conn, StatusInternalServerError)
-		return
+		if isTimeout(err) {
+			s.logs.Errorf(srv, LogError, "fastcgi backend %s timed out for %s %s: %s", srv.FastCGIPass, req.Method, req.Uri, err)
+			return srv, errorResponse(srv, StatusGatewayTimeout), false
+		}
+		s.logs.Errorf(srv, LogError, "fastcgi backend %s failed for %s %s: %s", srv.FastCGIPass, req.Method, req.Uri, err)
+		return srv, errorResponse(srv, StatusBadGateway), false
 	}
+	return srv, res, keepAlive
 }
 
-func processRequest(req *Request) (int, map[string]string, []byte, error) {
-	headers := make(map[string]string)
-	body := make([]byte, 0)
-	code := 200 // TODO
+// handleProxy returns the response of the upstream of the server
+func (s *Server) handleProxy(req *Request, srv *ServerConf, keepAlive bool) (*ServerConf, *Response, bool) {
+	res, err := s.proxyResponse(req, srv)
+	if err != nil {
+		var berr *bodyError
+		var nerr net.Error
+		switch {
+		case errors.As(err, &berr):
+			s.logs.Errorf(srv, LogInfo, "error reading the body of %s %s: %s", req.Method, req.Uri, err)
+			return srv, errorResponse(srv, bodyErrorCode(err)), false
+		case errors.As(err, &nerr) && nerr.Timeout():
+			s.logs.Errorf(srv, LogError, "upstream timed out for %s %s: %s", req.Method, req.Uri, err)
+			return srv, errorResponse(srv, StatusGatewayTimeout), false
+		}
+		s.logs.Errorf(srv, LogError, "error proxying %s %s: %s", req.Method, req.Uri, err)
+		return srv, errorResponse(srv, StatusBadGateway), false
+	}
+	return srv, res, keepAlive
+}
 
-	body = append(body, []byte("Hello, world")...) // TODO
-	headers["Content-Type"] = "text/html"          // TODO
-	return code, headers, body, nil
+// sendResponse writes the response and closes its body, it returns
+// whether the connection can be used for the next request
+func sendResponse(conn net.Conn, req *Request, res *Response, keepAlive bool) bool {
+	if c, ok := res.Body.(io.Closer); ok {
+		defer c.Close()
+	}
+	// HTTP/1.0 clients don't know about chunks, the body is sent
+	// as it is and its end is when the connection is closed
+	if res.ContentLength < 0 && res.hasBody() && isHTTP10(req) {
+		keepAlive = false
+	}
+	setConnectionHeader(res.Headers, keepAlive)
+	if err := res.Write(conn, req); err != nil {
+		log.Printf("error writing response %s", err)
+		return false
+	}
+	return keepAlive
 }
 
-func writeErrResponse(conn net.Conn, code int) {
-	msg, _ := GetStatusCodeMessage(code)
-	bytes := BuildResponseBytes(SendErrorResponse(code, msg))
-	_, err := conn.Write(bytes)
+// prepareBody limits the body of the request to the maximum size allowed by
+// the server and sends the "100 Continue" response when the client asks for it,
+// it returns the status code of the error response when the body is rejected
+func prepareBody(conn net.Conn, req *Request, srv *ServerConf) int {
+	maxBodySize := srv.maxBodySize()
+	if req.ContentLength > maxBodySize {
+		return StatusPayloadTooLarge
+	}
+	if req.Headers.Get("Expect") != "" {
+		if !req.ExpectsContinue() {
+			return StatusExpectationFailed
+		}
+		if req.ContentLength != 0 {
+			req.expect = &continueReader{r: req.Body, w: conn}
+			req.Body = req.expect
+		}
+	}
+	req.Body = &maxBodyReader{r: req.Body, n: maxBodySize}
+	return 0
+}
+
+// bodyErrorCode returns the status code to use
+// for an error found when reading the body
+func bodyErrorCode(err error) int {
+	if errors.Is(err, ErrBodyTooLarge) {
+		return StatusPayloadTooLarge
+	}
+	if errors.Is(err, ErrHeadersTooLarge) {
+		return StatusRequestHeaderFieldsTooLarge
+	}
+	if isTimeout(err) {
+		return StatusRequestTimeout
+	}
+	return StatusBadRequest
+}
+
+// parseErrorCode returns the status code to use
+// for an error found when parsing a request
+func parseErrorCode(err error) int {
+	if errors.Is(err, ErrHTTPVersionNotSupported) {
+		return StatusHTTPVersionNotSupported
+	}
+	if errors.Is(err, ErrUnsupportedEncoding) {
+		return StatusNotImplemented
+	}
+	if errors.Is(err, ErrRequestLineTooLong) {
+		return StatusURITooLong
+	}
+	if errors.Is(err, ErrHeadersTooLarge) {
+		return StatusRequestHeaderFieldsTooLarge
+	}
+	if isTimeout(err) {
+		return StatusRequestTimeout
+	}
+	return StatusBadRequest
+}
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// clientConn is the connection of a client, the body of a request can take
+// readTimeout between every read and the response writeTimeout between every
+// write, the deadlines are not changed when the timeouts are 0
+type clientConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *clientConn) Read(p []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *clientConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// processRequest finds the file that the request is asking for
+// under the root of the server and returns a response that sends it
+func processRequest(req *Request, srv *ServerConf) (*Response, error) {
+	name, err := resolveFile(req.Uri, srv)
+	if errors.Is(err, errNoIndexPage) && srv.autoindex() {
+		return autoindexResponse(req, srv, name)
+	}
 	if err != nil {
-		log.Printf("error writing error response %s", err)
+		return NewResponse(fileErrorCode(err), nil, nil, 0), nil
+	}
+	headers := make(textproto.MIMEHeader)
+	f, info, gzipped := precompressedFile(req, srv, name)
+	if gzipped {
+		headers.Set("Content-Encoding", encodingGzip)
+	} else {
+		if f, err = os.Open(name); err != nil {
+			return openErrorResponse(err)
+		}
+		if info, err = f.Stat(); err != nil {
+			f.Close()
+			return openErrorResponse(err)
+		}
+	}
+	if srv.compressionStatic() && srv.compressesType(getContentType(name)) {
+		headers.Set("Vary", "Accept-Encoding")
+	}
+	etag := fileETag(info, srv.etag())
+	if etag != "" {
+		headers.Set("ETag", etag)
+	}
+	headers.Set("Last-Modified", info.ModTime().UTC().Format(timeFormat))
+	if code := checkPreconditions(req, etag, info.ModTime()); code != 0 {
+		f.Close()
+		if code == StatusPreconditionFailed {
+			return NewResponse(code, nil, nil, 0), nil
+		}
+		return NewResponse(code, headers, nil, 0), nil
+	}
+	headers.Set("Content-Type", getContentType(name))
+	headers.Set("Accept-Ranges", "bytes")
+	if res := rangeResponse(req, f, info.Size(), headers, etag, info.ModTime()); res != nil {
+		if res.Body == nil {
+			f.Close()
+		}
+		return res, nil
+	}
+	return NewResponse(StatusOk, headers, f, info.Size()), nil
+}
+
+// openErrorResponse returns the error response for a file that
+// could not be opened, or the error itself if it's unexpected
+func openErrorResponse(err error) (*Response, error) {
+	err = fileError(err)
+	if errors.Is(err, errFileNotFound) || errors.Is(err, errFileForbidden) {
+		return NewResponse(fileErrorCode(err), nil, nil, 0), nil
+	}
+	return nil, err
+}
+
+func fileErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errFileNotFound):
+		return StatusNotFound
+	case errors.Is(err, errFileForbidden):
+		return StatusForbidden
+	}
+	return StatusInternalServerError
+}
+
+// errorResponse returns the error page of the server for the status code,
+// or the default one if the server doesn't have it, the server is nil when
+// it's not known yet
+func errorResponse(srv *ServerConf, code int) *Response {
+	if res := errorPageResponse(srv, code); res != nil {
+		return res
+	}
+	msg, _ := GetStatusCodeMessage(code)
+	return SendErrorResponse(code, msg)
+}
+
+func setConnectionHeader(headers textproto.MIMEHeader, keepAlive bool) {
+	if keepAlive {
+		headers.Set("Connection", "keep-alive")
+	} else {
+		headers.Set("Connection", "close")
+	}
+}
+
+// findServer returns the virtual host that listens on the port
+// and that is named after the host, if none of the virtual hosts
+// are a match, the default server is used
+func findServer(conf *Conf, port int, host string) *ServerConf {
+	for i := range conf.Vhosts {
+		vhost := &conf.Vhosts[i]
+		if !vhost.listensOn(port) {
+			continue
+		}
+		if vhost.isNamed(host) {
+			return vhost
+		}
 	}
+	return conf.DefaultServer
 }
 
 func getPortsToListen(conf *Conf) ([]int, error) {
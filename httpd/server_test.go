@@ -1,21 +1,50 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/fcgi"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/user"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
 
 func TestMain(m *testing.M) {
-	cmd, err := startServer("testdata/httpd.conf")
+	confFile, err := keepUserConf("testdata/httpd.conf")
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	defer os.RemoveAll(filepath.Dir(confFile))
+	cmd, err := startServer(confFile)
 	if err != nil {
 		log.Fatalf("server could not be started: %s\n", err)
 	}
@@ -70,8 +99,92 @@ func TestLargePostRequest(t *testing.T) {
 	}
 }
 
+func TestChunkedPostRequest(t *testing.T) {
+	f, err := os.Open("testdata/post_data.txt")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer f.Close()
+	// the length of a MultiReader is unknown, so the body is sent in chunks
+	res, err := http.Post("http://localhost:8081", "text/plain", io.MultiReader(f))
+	if err != nil {
+		t.Fatalf("error sending POST request: %s\n", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected a 200 response, got: %d\n", res.StatusCode)
+	}
+}
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	confFile := writeTestConf(t, "port = 8095\nmax_body_size = 1k\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	tests := []struct {
+		body io.Reader
+		code int
+	}{
+		{strings.NewReader(strings.Repeat("a", 1024)), 200},
+		{strings.NewReader(strings.Repeat("a", 1025)), 413},
+		{io.MultiReader(strings.NewReader(strings.Repeat("a", 1024))), 200},
+		{io.MultiReader(strings.NewReader(strings.Repeat("a", 2048))), 413},
+	}
+	for i, test := range tests {
+		res, err := http.Post("http://localhost:8095", "text/plain", test.body)
+		if err != nil {
+			t.Fatalf("error sending POST request: %s\n", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("POST #%d expected a %d response, got: %d\n", i+1, test.code, res.StatusCode)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:8081")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("error reading the interim response: %s\n", err)
+	}
+	if line != "HTTP/1.1 100 Continue\r\n" {
+		t.Fatalf("expected a 100 Continue response, got: %q\n", line)
+	}
+	if line, _ := r.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("the interim response should not have headers, got: %q\n", line)
+	}
+	fmt.Fprintf(conn, "hello")
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("error reading response: %s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected a 200 response, got: %d\n", res.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: something-else\r\n\r\n")
+	res, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("error reading response: %s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 417 {
+		t.Errorf("expected a 417 response, got: %d\n", res.StatusCode)
+	}
+}
+
 func TestLargeRequestLine(t *testing.T) {
-	url := `http://localhost:8081/vod/FetchOrderDetails?itemId=233756825167&transactionId=1921811535013&mkevt=1&mkpid=0&emsid=e11401.m43700.l49689&mkcid=7&ch=osgood&euid=cd3dbb358e3b4633b21e32c5e7b1ded2&bu=43783229363&exe=98631&ext=232562&some1=43783229363&test1=1234567789898232&tryid=12938129381293812938&console=912839812938123&logid=nqt%3DAAAAEAAAACAgAAAAAAAAAACAAAAAAAAAAAAAAAAAAAAAIAAAAAAAAAAAABAAAAAAAAAAEAAAAAAAAAAAAAAAAAAAgAAAQAAAAAAAACAAAAgAAAAAgAAAAAAAAAAAAAAAgA**%26nqc%3DAAAAEAAAACAgAAAAAAAAAACAAAAAAAAAAAAAAAAAAAAAIAAAAAAAAAAAABAAAAAAAAAAEAAAAAAAAAAAAAAAAAAAgAAAQAAAAAAAACAAAAgAAAAAgAAAAAAAAAAAAAAAgA**%26mdbreftime%3D1622479417918%26es%3D0%26ec%3D1&osub=-1~1&crd=20210531095122&segname=11401&sojTags=ch%3Dch%2Cbu%3Dbu%2Cnqt%3Dnqt%2Cnqc%3Dnqc%2Cmdbreftime%3Dmdbreftime%2Ces%3Des%2Cec%3Dec%2Cexe%3Dexe%2Cext%3Dext%2Cexe%3Dexe%2Cext%3Dext%2Cosub%3Dosub%2Ccrd%3Dcrd%2Csegname%3Dsegname%2Cchnl%3Dmkcid`
+	url := `http://localhost:8081/?itemId=233756825167&transactionId=1921811535013&mkevt=1&mkpid=0&emsid=e11401.m43700.l49689&mkcid=7&ch=osgood&euid=cd3dbb358e3b4633b21e32c5e7b1ded2&bu=43783229363&exe=98631&ext=232562&some1=43783229363&test1=1234567789898232&tryid=12938129381293812938&console=912839812938123&logid=nqt%3DAAAAEAAAACAgAAAAAAAAAACAAAAAAAAAAAAAAAAAAAAAIAAAAAAAAAAAABAAAAAAAAAAEAAAAAAAAAAAAAAAAAAAgAAAQAAAAAAAACAAAAgAAAAAgAAAAAAAAAAAAAAAgA**%26nqc%3DAAAAEAAAACAgAAAAAAAAAACAAAAAAAAAAAAAAAAAAAAAIAAAAAAAAAAAABAAAAAAAAAAEAAAAAAAAAAAAAAAAAAAgAAAQAAAAAAAACAAAAgAAAAAgAAAAAAAAAAAAAAAgA**%26mdbreftime%3D1622479417918%26es%3D0%26ec%3D1&osub=-1~1&crd=20210531095122&segname=11401&sojTags=ch%3Dch%2Cbu%3Dbu%2Cnqt%3Dnqt%2Cnqc%3Dnqc%2Cmdbreftime%3Dmdbreftime%2Ces%3Des%2Cec%3Dec%2Cexe%3Dexe%2Cext%3Dext%2Cexe%3Dexe%2Cext%3Dext%2Cosub%3Dosub%2Ccrd%3Dcrd%2Csegname%3Dsegname%2Cchnl%3Dmkcid`
 	res, err := http.Get(url)
 	if err != nil {
 		t.Fatalf("error sending GET request: %s\n", err)
@@ -92,60 +205,2163 @@ func TestLargeRequestLine(t *testing.T) {
 	}
 }
 
-func TestGetPortsToListen(t *testing.T) {
+func TestStaticFiles(t *testing.T) {
 	tests := []struct {
-		c    *Conf
-		want []int
+		uri         string
+		code        int
+		contentType string
+		body        string
 	}{
-		{
-			&Conf{
-				User:  "foo",
-				Group: "bar",
-				DefaultServer: &ServerConf{
-					Names: []string{"one", "two", "three"},
-					Root:  "/foo/bar",
-					Ports: []int{80, 8080, 8081},
-				},
-			},
-			[]int{80, 8080, 8081},
-		},
-		{
-			&Conf{
-				User:  "baz",
-				Group: "bazzer",
-				DefaultServer: &ServerConf{
-					Names: []string{"bee", "sting", "print"},
-					Root:  "/tmp/server",
-					Ports: []int{80, 443, 80, 80, 9090, 9090, 9091},
-				},
-			},
-			[]int{80, 443, 9090, 9091},
-		},
+		{"/", 200, "text/html; charset=utf-8", "Hello, world"},
+		{"/index.html", 200, "text/html; charset=utf-8", "Hello, world"},
+		{"/css/style.css", 200, "text/css; charset=utf-8", "body {\n    margin: 0;\n}\n"},
+		{"/docs/", 200, "text/html; charset=utf-8", "Docs index\n"},
+		{"/docs/../index.html", 200, "text/html; charset=utf-8", "Hello, world"},
+		{"/../../server.go", 404, "", ""},
+		{"/not_found.html", 404, "", ""},
+		{"/index.html/foo", 404, "", ""},
+		{"/empty/", 403, "", ""},
+	}
+	for _, test := range tests {
+		res, err := http.Get("http://localhost:8081" + test.uri)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("error reading response body: %s\n", err)
+		}
+		if res.StatusCode != test.code {
+			t.Errorf("GET %s expected a %d response, got: %d\n", test.uri, test.code, res.StatusCode)
+			continue
+		}
+		if test.code != 200 {
+			continue
+		}
+		if ct := res.Header.Get("Content-Type"); ct != test.contentType {
+			t.Errorf("GET %s returned the wrong content type, got %s but want %s\n", test.uri, ct, test.contentType)
+		}
+		if string(b) != test.body {
+			t.Errorf("GET %s returned the wrong body, got %q but want %q\n", test.uri, string(b), test.body)
+		}
 	}
+}
 
+func TestErrorPages(t *testing.T) {
+	tests := []struct {
+		url  string
+		host string
+		code int
+		body string
+	}{
+		{"http://localhost:8081/not_found.html", "localhost", 404, "Page not found\n"},
+		{"http://localhost:8081/empty/", "localhost", 403, "Something went wrong\n"},
+		{"http://localhost:8081/not_found.html", "mydomain.com", 404, "mydomain.com error\n"},
+		{"http://localhost:80/not_found.html", "another.com", 404, "404 Not Found"},
+	}
 	for _, test := range tests {
-		ports, err := getPortsToListen(test.c)
+		req, err := http.NewRequest("GET", test.url, nil)
 		if err != nil {
-			t.Errorf("getPortsToListen() returned an error: %s\n", err)
+			t.Fatalf("error creating GET request: %s\n", err)
 		}
-		if !reflect.DeepEqual(ports, test.want) {
-			t.Errorf("getPortsToListen() returned the wrong ports, got %v but want %v\n", ports, test.want)
+		req.Host = test.host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("error reading response body: %s\n", err)
+		}
+		if res.StatusCode != test.code {
+			t.Errorf("GET %s (Host: %s) expected a %d response, got: %d\n", test.url, test.host, test.code, res.StatusCode)
+		}
+		if string(b) != test.body {
+			t.Errorf("GET %s (Host: %s) returned the wrong error page, got %q but want %q\n", test.url, test.host, string(b), test.body)
 		}
 	}
 }
 
-func TestGetPortsToListenWithNoPorts(t *testing.T) {
+func TestAccessAndErrorLogs(t *testing.T) {
+	uri := fmt.Sprintf("/logged-%d.html", time.Now().UnixNano())
+	for _, host := range []string{"localhost", "mydomain.com"} {
+		req, err := http.NewRequest("GET", "http://localhost:8081"+uri, nil)
+		if err != nil {
+			t.Fatalf("error creating GET request: %s\n", err)
+		}
+		req.Host = host
+		req.Header.Set("User-Agent", "httpd-test")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"testdata/logs/access.log", "\"GET " + uri + " HTTP/1.1\" 404 15 \"-\" \"httpd-test\""},
+		{"testdata/logs/errors.log", "[info] GET " + uri + ": Not Found"},
+		{"testdata/logs/mydomain.com.access.log", "mydomain.com \"GET " + uri + " HTTP/1.1\" 404"},
+	}
+	for _, test := range tests {
+		b, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatalf("error reading log file: %s\n", err)
+		}
+		if !strings.Contains(string(b), test.want) {
+			t.Errorf("%s does not have %q\n", test.file, test.want)
+		}
+	}
+	// the level of the error log of mydomain.com is "error"
+	b, _ := ioutil.ReadFile("testdata/logs/mydomain.com.error.log")
+	if strings.Contains(string(b), uri) {
+		t.Errorf("info messages should not be in the error log of mydomain.com\n")
+	}
+}
+
+func TestLogsAreReopenedOnSIGUSR1(t *testing.T) {
+	dir := t.TempDir()
+	accessLog := filepath.Join(dir, "access.log")
+	confFile := writeTestConf(t, "port = 8096\nlog_format = $request_uri\naccess_log = "+accessLog+"\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	get := func(uri string) {
+		res, err := http.Get("http://localhost:8096" + uri)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	get("/before")
+	if err := os.Rename(accessLog, accessLog+".1"); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatalf("error sending SIGUSR1: %s\n", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	get("/after")
+	time.Sleep(100 * time.Millisecond)
+	rotated, _ := ioutil.ReadFile(accessLog + ".1")
+	current, _ := ioutil.ReadFile(accessLog)
+	if string(rotated) != "/before\n" || string(current) != "/after\n" {
+		t.Errorf("the logs were not reopened, rotated: %q, current: %q\n", rotated, current)
+	}
+}
+
+func TestHeadRequest(t *testing.T) {
+	res, err := http.Head("http://localhost:8081/css/style.css")
+	if err != nil {
+		t.Fatalf("error sending HEAD request: %s\n", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected a 200 response, got: %d\n", res.StatusCode)
+	}
+	if res.ContentLength != int64(len("body {\n    margin: 0;\n}\n")) {
+		t.Errorf("HEAD should have the Content-Length of the file, got %d\n", res.ContentLength)
+	}
+	if res.Header.Get("Date") == "" {
+		t.Errorf("the Date header is missing\n")
+	}
+}
+
+func TestGetContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"index.html", "text/html; charset=utf-8"},
+		{"/var/www/app.JS", "application/javascript"},
+		{"image.png", "image/png"},
+		{"archive.tar.gz", "application/gzip"},
+		{"README", defaultContentType},
+		{"file.unknown", defaultContentType},
+	}
+	for _, test := range tests {
+		if ct := getContentType(test.name); ct != test.want {
+			t.Errorf("getContentType(%s) returned %s but want %s\n", test.name, ct, test.want)
+		}
+	}
+}
+
+func TestResolveFileSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		if err := os.WriteFile(filepath.Join(d, "index.html"), []byte("hello"), 0644); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+	}
+	os.Symlink("index.html", filepath.Join(root, "inside.html"))
+	os.Symlink(filepath.Join(outside, "index.html"), filepath.Join(root, "outside.html"))
+	os.Symlink(outside, filepath.Join(root, "outside"))
+	// the root itself can be a link
+	os.Symlink(root, filepath.Join(dir, "link"))
+	srv := &ServerConf{Root: filepath.Join(dir, "link"), IndexPages: []string{"index.html"}}
+	tests := []struct {
+		uri string
+		err error
+	}{
+		{"/", nil},
+		{"/inside.html", nil},
+		{"/outside.html", errFileForbidden},
+		{"/outside/", errFileForbidden},
+		{"/outside/index.html", errFileForbidden},
+	}
+	for _, test := range tests {
+		if _, err := resolveFile(test.uri, srv); err != test.err {
+			t.Errorf("resolveFile(%s) returned %v but want %v\n", test.uri, err, test.err)
+		}
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	tests := []struct {
+		url  string
+		host string
+		body string
+	}{
+		{"http://localhost:8081", "mydomain.com", "mydomain.com\n"},
+		{"http://localhost:8081", "www.mydomain.com:8081", "mydomain.com\n"},
+		{"http://localhost:8081", "WWW.MyDomain.com", "mydomain.com\n"},
+		{"http://localhost:8081", "another.com", "Hello, world"},
+		{"http://localhost:8081", "unknown.com", "Hello, world"},
+		{"http://localhost:80", "another.com", "another.com\n"},
+		{"http://localhost:80", "mydomain.com", "Hello, world"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatalf("error creating GET request: %s\n", err)
+		}
+		req.Host = test.host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("error reading response body: %s\n", err)
+		}
+		if res.StatusCode != 200 {
+			t.Errorf("GET %s (Host: %s) expected a 200 response, got: %d\n", test.url, test.host, res.StatusCode)
+			continue
+		}
+		if string(b) != test.body {
+			t.Errorf("GET %s (Host: %s) returned the wrong body, got %q but want %q\n", test.url, test.host, string(b), test.body)
+		}
+	}
+}
+
+func TestFindServer(t *testing.T) {
 	c := &Conf{
-		User:  "foo",
-		Group: "bar",
 		DefaultServer: &ServerConf{
-			Names: []string{"one", "two", "three"},
-			Root:  "/foo/bar",
-			Ports: []int{},
+			Names: []string{"localhost"},
+			Root:  "/var/www/localhost",
+			Ports: []int{80},
+		},
+		Vhosts: []ServerConf{
+			{
+				Names: []string{"example.com", "www.example.com"},
+				Root:  "/var/www/example.com",
+				Ports: []int{80, 8080},
+			},
+			{
+				Names: []string{"*.test.com"},
+				Root:  "/var/www/test.com",
+				Ports: []int{8080},
+			},
 		},
 	}
-	if _, err := getPortsToListen(c); err == nil {
-		t.Errorf("getPortsToListen() should return an error\n")
+	tests := []struct {
+		port int
+		host string
+		want string
+	}{
+		{80, "localhost", "/var/www/localhost"},
+		{80, "example.com", "/var/www/example.com"},
+		{8080, "www.example.com", "/var/www/example.com"},
+		{80, "foo.test.com", "/var/www/localhost"},
+		{8080, "foo.test.com", "/var/www/test.com"},
+		{8080, "test.com", "/var/www/localhost"},
+		{9090, "example.com", "/var/www/localhost"},
+	}
+	for _, test := range tests {
+		srv := findServer(c, test.port, test.host)
+		if srv.Root != test.want {
+			t.Errorf("findServer(%d, %s) returned the server at %s but want %s\n", test.port, test.host, srv.Root, test.want)
+		}
+	}
+}
+
+func TestConfigurationTest(t *testing.T) {
+	// the user file can't be read, every request would fail
+	missingUsers := writeTestConf(t, "port = 8116\nauth_basic = Admin\nauth_basic_user_file = testdata/missing.htpasswd\n")
+	tests := []struct {
+		confFile string
+		ok       bool
+	}{
+		{"testdata/httpd.conf", true},
+		{"testdata/syntax_errors.conf", false},
+		{"testdata/include/bad.conf", false},
+		{"testdata/not_found.conf", false},
+		{missingUsers, false},
+	}
+	for _, test := range tests {
+		out, err := exec.Command("./httpd", "-t", "-c", test.confFile).CombinedOutput()
+		if test.ok && err != nil {
+			t.Errorf("httpd -t failed for %s: %s\n%s\n", test.confFile, err, out)
+		}
+		if !test.ok {
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+				t.Errorf("httpd -t should exit with 1 for %s, got %v\n%s\n", test.confFile, err, out)
+			}
+		}
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	confFile := writeTestConf(t, "port = 8090\nshutdown_timeout = 5s\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	// a request that is still being sent when the server is told to stop
+	conn, err := net.Dial("tcp", "localhost:8090")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\n")
+	time.Sleep(100 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("error sending SIGTERM: %s\n", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := net.Dial("tcp", "localhost:8090"); err == nil {
+		t.Errorf("the server should not accept new connections after SIGTERM\n")
+	}
+	fmt.Fprintf(conn, "Host: localhost\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("error reading the response of the in-flight request: %s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected a 200 response, got: %d\n", res.StatusCode)
+	}
+	if err := waitTestServer(cmd, 5*time.Second); err != nil {
+		t.Errorf("%s\n", err)
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	confFile := writeTestConf(t, "port = 8091,8092\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	// an open connection that should survive the reload
+	conn, err := net.Dial("tcp", "localhost:8092")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer conn.Close()
+
+	root, _ := filepath.Abs("testdata/www/mydomain.com")
+	newConf := fmt.Sprintf("port = 8092,8093\nroot = %s\nindex = index.html\n", root)
+	if err := os.WriteFile(confFile, []byte(newConf), 0644); err != nil {
+		t.Fatalf("error writing the configuration: %s\n", err)
+	}
+	if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("error sending SIGHUP: %s\n", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	if _, err := net.Dial("tcp", "localhost:8091"); err == nil {
+		t.Errorf("the server should not listen on a removed port\n")
+	}
+	res, err := http.Get("http://localhost:8093")
+	if err != nil {
+		t.Fatalf("error sending GET request to the new port: %s\n", err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(b) != "mydomain.com\n" {
+		t.Errorf("the new configuration is not used, got %q\n", string(b))
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("the open connection was dropped: %s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected a 200 response, got: %d\n", res.StatusCode)
+	}
+}
+
+func TestPersistentConnection(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:8081")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer conn.Close()
+	// pipelined requests, sent before any response is read
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /not_found.html HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /css/style.css HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	r := bufio.NewReader(conn)
+	for _, code := range []int{200, 404, 200} {
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("error reading response: %s\n", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("expected a %d response, got: %d\n", code, res.StatusCode)
+		}
+		if res.Close {
+			t.Errorf("the connection should be kept open\n")
+		}
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("error reading response: %s\n", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !res.Close {
+		t.Errorf("the response should have Connection: close\n")
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("the connection should be closed by the server\n")
+	}
+}
+
+func TestHTTP10ConnectionIsClosed(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:8081")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.0\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("error reading response: %s\n", err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !res.Close {
+		t.Errorf("the response should have Connection: close\n")
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("the connection should be closed by the server\n")
+	}
+}
+
+func TestKeepAliveLimits(t *testing.T) {
+	confFile := writeTestConf(t, "port = 8094\nkeepalive_timeout = 1s\nkeepalive_requests = 2\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	conn, err := net.Dial("tcp", "localhost:8094")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for i, close := range []bool{false, true} {
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("error reading response: %s\n", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.Close != close {
+			t.Errorf("request #%d should have closed the connection: %v\n", i+1, close)
+		}
+	}
+
+	// an idle connection is closed after the timeout
+	idle, err := net.Dial("tcp", "localhost:8094")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if _, err := idle.Read(make([]byte, 1)); err == nil || time.Since(start) > 2*time.Second {
+		t.Errorf("the idle connection should be closed after 1s, got %v after %s\n", err, time.Since(start))
+	}
+}
+
+func TestTLSWithSNI(t *testing.T) {
+	dir := t.TempDir()
+	localCert, localKey := writeTestCert(t, dir, "localhost")
+	anotherCert, anotherKey := writeTestCert(t, dir, "another.test")
+	another, err := filepath.Abs("testdata/www/another.com")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	confFile := writeTestConf(t, fmt.Sprintf(`name = localhost
+port = 8097, 8443 tls
+ssl_certificate = %s
+ssl_certificate_key = %s
+https_redirect = on
+vhost {
+    name = another.test
+    port = 8443 tls
+    root = %s
+    ssl_certificate = %s
+    ssl_certificate_key = %s
+    tls_min_version = 1.3
+}
+`, localCert, localKey, another, anotherCert, anotherKey))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	tests := []struct {
+		serverName string
+		body       string
+	}{
+		{"localhost", "Hello, world"},
+		{"another.test", "another.com"},
+		// unknown names get the certificate of the default server
+		{"unknown.test", "Hello, world"},
+	}
+	for _, test := range tests {
+		conn, err := tls.Dial("tcp", "localhost:8443", &tls.Config{ServerName: test.serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("error connecting to %s: %s\n", test.serverName, err)
+		}
+		wantName := test.serverName
+		if wantName == "unknown.test" {
+			wantName = "localhost"
+		}
+		certs := conn.ConnectionState().PeerCertificates
+		if len(certs) == 0 || certs[0].Subject.CommonName != wantName {
+			t.Errorf("the certificate for %s should be the one of %s\n", test.serverName, wantName)
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", test.serverName)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("error reading response: %s\n", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		conn.Close()
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(body), test.body) {
+			t.Errorf("GET https://%s/ returned %d %q\n", test.serverName, res.StatusCode, body)
+		}
+	}
+
+	// the vhost doesn't allow anything older than tls 1.3
+	conn, err := tls.Dial("tcp", "localhost:8443", &tls.Config{ServerName: "another.test", InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Errorf("the handshake with tls 1.2 should fail\n")
+	}
+
+	// plain http is redirected to https
+	plain, err := net.Dial("tcp", "localhost:8097")
+	if err != nil {
+		t.Fatalf("error connecting to the server: %s\n", err)
+	}
+	defer plain.Close()
+	fmt.Fprintf(plain, "GET /css/style.css?v=1 HTTP/1.1\r\nHost: localhost:8097\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(plain), nil)
+	if err != nil {
+		t.Fatalf("error reading response: %s\n", err)
+	}
+	res.Body.Close()
+	want := "https://localhost:8443/css/style.css?v=1"
+	if res.StatusCode != http.StatusMovedPermanently || res.Header.Get("Location") != want {
+		t.Errorf("expected a redirect to %s, got %d %s\n", want, res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+func TestFastCGI(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "fcgi.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer l.Close()
+	// a responder that stands in for php-fpm
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		if strings.HasSuffix(env["SCRIPT_FILENAME"], "missing.php") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "no such script")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+		fmt.Fprintf(w, "%s %s %s %d %s %s", r.Method, r.URL.Path, r.URL.RawQuery, r.ContentLength, body, r.Header.Get("X-Test"))
+	}))
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8098
+index = index.php, index.html
+error_page = error.html
+fastcgi_pass = unix:%s
+fastcgi_match = .php
+vhost {
+    name = down.test
+    port = 8098
+    fastcgi_pass = unix:%s.missing
+}
+`, sock, sock))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	root, _ := filepath.Abs("testdata/www/localhost")
+	tests := []struct {
+		method string
+		uri    string
+		body   io.Reader
+		host   string
+		code   int
+		want   string
+		script string
+	}{
+		{"GET", "/app/index.php/users?id=1", nil, "localhost", 200, "GET /app/index.php/users id=1 0  test", "/app/index.php"},
+		{"GET", "/app/", nil, "localhost", 200, "GET /app/  0  test", "/app/index.php"},
+		{"POST", "/app/index.php", strings.NewReader("name=value"), "localhost", 200, "POST /app/index.php  10 name=value test", "/app/index.php"},
+		{"POST", "/app/index.php", io.MultiReader(strings.NewReader("chunked")), "localhost", 200, "POST /app/index.php  7 chunked test", "/app/index.php"},
+		// the errors of the script are not replaced by the error pages
+		{"GET", "/missing.php", nil, "localhost", 404, "no such script", ""},
+		{"GET", "/css/style.css", nil, "localhost", 200, "", ""},
+		{"GET", "/index.php", nil, "down.test", 502, "", ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "http://localhost:8098"+test.uri, test.body)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		req.Host = test.host
+		req.Header.Set("X-Test", "test")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending %s %s: %s\n", test.method, test.uri, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("%s %s returned %d but want %d\n", test.method, test.uri, res.StatusCode, test.code)
+		}
+		if test.want != "" && string(body) != test.want {
+			t.Errorf("%s %s returned %q but want %q\n", test.method, test.uri, body, test.want)
+		}
+		if test.script != "" && res.Header.Get("X-Script") != filepath.Join(root, test.script) {
+			t.Errorf("%s %s ran %s but want %s\n", test.method, test.uri, res.Header.Get("X-Script"), test.script)
+		}
+	}
+}
+
+func TestFastCGIBackendTimeoutAndContinue(t *testing.T) {
+	dir := t.TempDir()
+	// a backend that answers without reading the body
+	l, err := net.Listen("unix", filepath.Join(dir, "fcgi.sock"))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer l.Close()
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "done")
+	}))
+	// and one that never answers
+	hung, err := net.Listen("unix", filepath.Join(dir, "hung.sock"))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer hung.Close()
+	go func() {
+		for {
+			c, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8117
+fastcgi_pass = unix:%s
+vhost {
+    name = hung.test
+    port = 8117
+    fastcgi_pass = unix:%s
+    fastcgi_timeout = 1s
+}
+`, l.Addr(), hung.Addr()))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	req, _ := http.NewRequest("GET", "http://localhost:8117/index.php", nil)
+	req.Host = "hung.test"
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout || time.Since(start) > 5*time.Second {
+		t.Errorf("expected a 504 after the timeout but got %d after %s\n", res.StatusCode, time.Since(start))
+	}
+
+	// the "100 Continue" always comes before the response
+	conn, err := net.Dial("tcp", "localhost:8117")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /index.php HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\nConnection: close\r\n\r\n")
+	br := bufio.NewReader(conn)
+	line, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HTTP/1.1 100") {
+		t.Fatalf("expected a 100 Continue but got %q, %v\n", line, err)
+	}
+	if line, _ := br.ReadString('\n'); line != "\r\n" {
+		t.Fatalf("the 100 Continue should not have headers, got %q\n", line)
+	}
+	fmt.Fprintf(conn, "hello")
+	res, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("error reading the response: %s\n", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != "done" {
+		t.Errorf("expected a 200 with done but got %d %q\n", res.StatusCode, body)
+	}
+}
+
+func TestReverseProxy(t *testing.T) {
+	// two live backends and one that is down
+	addrs := make([]string, 0)
+	for _, id := range []string{"one", "two"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		defer l.Close()
+		id := id
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Header().Set("X-Backend", id)
+			w.Header().Set("X-Remote", r.RemoteAddr)
+			fmt.Fprintf(w, "%s %s %s %s %s %s", r.Method, r.URL.RequestURI(), r.Host, r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), body)
+		}))
+		addrs = append(addrs, l.Addr().String())
+	}
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	dead.Close()
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8099
+upstream backend {
+    server = %s, %s, %s
+    max_fails = 1
+    fail_timeout = 1m
+}
+upstream sticky {
+    server = %s, %s
+    balance = ip_hash
+}
+vhost {
+    name = proxy.test
+    port = 8099
+    proxy_pass = http://backend
+}
+vhost {
+    name = sticky.test
+    port = 8099
+    proxy_pass = http://sticky/api/
+}
+vhost {
+    name = down.test
+    port = 8099
+    proxy_pass = http://%s
+}
+`, addrs[0], dead.Addr(), addrs[1], addrs[0], addrs[1], dead.Addr()))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	send := func(host, method, uri string, body io.Reader) (*http.Response, string) {
+		req, err := http.NewRequest(method, "http://localhost:8099"+uri, body)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		req.Host = host
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending %s %s: %s\n", method, uri, err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res, string(b)
+	}
+
+	// the dead backend is skipped and the others take turns
+	backends := make(map[string]int)
+	remotes := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		res, body := send("proxy.test", "GET", "/users?id=1", nil)
+		if res.StatusCode != 200 {
+			t.Fatalf("GET /users returned %d\n", res.StatusCode)
+		}
+		if want := "GET /users?id=1 proxy.test 127.0.0.1 http "; body != want {
+			t.Errorf("the backend got %q but want %q\n", body, want)
+		}
+		backends[res.Header.Get("X-Backend")]++
+		remotes[res.Header.Get("X-Remote")] = true
+	}
+	if backends["one"] != 3 || backends["two"] != 3 {
+		t.Errorf("the requests should be balanced between the backends, got %v\n", backends)
+	}
+	if len(remotes) != 2 {
+		t.Errorf("the connections to the backends should be reused, got %d of them\n", len(remotes))
+	}
+
+	for _, body := range []io.Reader{strings.NewReader("hello"), io.MultiReader(strings.NewReader("hello"))} {
+		res, got := send("proxy.test", "POST", "/form", body)
+		if res.StatusCode != 200 || !strings.HasSuffix(got, " hello") {
+			t.Errorf("POST /form returned %d %q\n", res.StatusCode, got)
+		}
+	}
+
+	// ip_hash always uses the same backend and the path of proxy_pass is added
+	first := ""
+	for i := 0; i < 4; i++ {
+		res, body := send("sticky.test", "GET", "/items", nil)
+		if !strings.HasPrefix(body, "GET /api/items ") {
+			t.Errorf("the backend got %q for /items\n", body)
+		}
+		if first == "" {
+			first = res.Header.Get("X-Backend")
+		} else if res.Header.Get("X-Backend") != first {
+			t.Errorf("ip_hash should use the same backend for every request\n")
+		}
+	}
+
+	if res, _ := send("down.test", "GET", "/", nil); res.StatusCode != http.StatusBadGateway {
+		t.Errorf("a backend that is down should return 502, got %d\n", res.StatusCode)
+	}
+}
+
+func TestStreamedResponseToHTTP10(t *testing.T) {
+	// the backend flushes before it's done, there's no Content-Length
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "Hello, ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "world")
+	}))
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8115
+proxy_pass = http://%s
+`, l.Addr()))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	conn, err := net.Dial("tcp", "localhost:8115")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.0\r\nHost: localhost\r\n\r\n")
+	// the whole response is read, the server closes the connection after the body
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("the connection was not closed after the body: %s\n", err)
+	}
+	head, body, _ := strings.Cut(string(b), "\r\n\r\n")
+	if !strings.HasPrefix(head, "HTTP/1.1 200") {
+		t.Errorf("expected a 200 but got %q\n", head)
+	}
+	if strings.Contains(strings.ToLower(head), "transfer-encoding") {
+		t.Errorf("a response to HTTP/1.0 should not be chunked: %q\n", head)
+	}
+	if body != "Hello, world" {
+		t.Errorf("expected the body %q but got %q\n", "Hello, world", body)
+	}
+
+	// HEAD doesn't get a Transfer-Encoding either
+	res, err := http.Head("http://localhost:8115/")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	res.Body.Close()
+	if len(res.TransferEncoding) != 0 || res.Header.Get("Transfer-Encoding") != "" {
+		t.Errorf("a HEAD response should not have a Transfer-Encoding: %v\n", res.TransferEncoding)
+	}
+}
+
+func TestFailingUpstreamIsEjected(t *testing.T) {
+	// one backend that is up but keeps failing and a good one
+	addrs := make([]string, 0)
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusOK} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		defer l.Close()
+		code := code
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		addrs = append(addrs, l.Addr().String())
+	}
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8118
+upstream backend {
+    server = %s, %s
+    max_fails = 1
+    fail_timeout = 1m
+}
+proxy_pass = http://backend
+`, addrs[0], addrs[1]))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	codes := make([]int, 0)
+	for i := 0; i < 4; i++ {
+		res, err := http.Get("http://localhost:8118/")
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		res.Body.Close()
+		codes = append(codes, res.StatusCode)
+	}
+	// the 503 of the failing backend is sent once, it's not used after that
+	want := []int{503, 200, 200, 200}
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("the responses were %v but want %v\n", codes, want)
+	}
+}
+
+func TestLocations(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.URL.RequestURI())
+	}))
+	mydomain, err := filepath.Abs("testdata/www/mydomain.com")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8100
+location /docs/ {
+    index = index.htm
+    methods = GET, HEAD
+}
+location ~ \.css$ {
+    root = %s
+    error_page = error.html
+}
+location /api/ {
+    proxy_pass = http://%s/v1/
+}
+`, mydomain, l.Addr()))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	tests := []struct {
+		method string
+		uri    string
+		code   int
+		body   string
+	}{
+		{"GET", "/", 200, "Hello, world"},
+		{"GET", "/docs/", 200, ""},
+		{"POST", "/docs/", 405, ""},
+		{"GET", "/css/style.css", 404, "mydomain.com error"},
+		{"GET", "/api/users?id=1", 200, "backend /v1/users?id=1"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "http://localhost:8100"+test.uri, nil)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending %s %s: %s\n", test.method, test.uri, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("%s %s returned %d but want %d\n", test.method, test.uri, res.StatusCode, test.code)
+		}
+		if test.body != "" && strings.TrimSpace(string(body)) != test.body {
+			t.Errorf("%s %s returned %q but want %q\n", test.method, test.uri, body, test.body)
+		}
+		if test.code == 405 && res.Header.Get("Allow") != "GET, HEAD" {
+			t.Errorf("the Allow header should list the methods, got %q\n", res.Header.Get("Allow"))
+		}
+	}
+}
+
+func TestRewrites(t *testing.T) {
+	confFile := writeTestConf(t, `port = 8101
+rewrite = ^/old/(.*)$ /$1 last
+location / {
+    return = 200 the root $request_uri
+}
+location = /index.html {
+}
+location = /moved {
+    return = 301 http://$host:8101/index.html
+}
+location /blog/ {
+    rewrite = ^/blog/(\d+)$ /posts/$1 permanent
+}
+`)
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	tests := []struct {
+		uri      string
+		code     int
+		body     string
+		location string
+	}{
+		{"/old/index.html", 200, "Hello, world", ""},
+		{"/moved", 301, "", "http://localhost:8101/index.html"},
+		{"/blog/12?page=2", 301, "", "/posts/12?page=2"},
+		{"/other?a=b", 200, "the root /other?a=b", ""},
+	}
+	for _, test := range tests {
+		res, err := client.Get("http://localhost:8101" + test.uri)
+		if err != nil {
+			t.Fatalf("error sending GET %s: %s\n", test.uri, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("GET %s returned %d but want %d\n", test.uri, res.StatusCode, test.code)
+		}
+		if test.body != "" && strings.TrimSpace(string(body)) != test.body {
+			t.Errorf("GET %s returned %q but want %q\n", test.uri, body, test.body)
+		}
+		if got := res.Header.Get("Location"); got != test.location {
+			t.Errorf("GET %s redirected to %q but want %q\n", test.uri, got, test.location)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	confFile := writeTestConf(t, `port = 8102
+location /css/ {
+    etag = weak
+}
+`)
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	res, err := http.Get("http://localhost:8102/index.html")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	res.Body.Close()
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if !strings.HasPrefix(etag, `"`) || lastModified == "" {
+		t.Fatalf("the response should have a strong ETag and Last-Modified, got %q and %q\n", etag, lastModified)
+	}
+	tests := []struct {
+		method string
+		header string
+		value  string
+		code   int
+	}{
+		{"GET", "If-None-Match", etag, 304},
+		{"GET", "If-None-Match", `"other"`, 200},
+		{"GET", "If-Modified-Since", lastModified, 304},
+		{"GET", "If-Match", `"other"`, 412},
+		{"GET", "If-Unmodified-Since", "Mon, 01 Jan 2001 00:00:00 GMT", 412},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, "http://localhost:8102/index.html", nil)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		req.Header.Set(test.header, test.value)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending %s with %s: %s\n", test.method, test.header, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("%s with %s: %s returned %d but want %d\n", test.method, test.header, test.value, res.StatusCode, test.code)
+		}
+		if res.StatusCode == 304 && res.Header.Get("ETag") != etag {
+			t.Errorf("the 304 response should have the ETag, got %q\n", res.Header.Get("ETag"))
+		}
+	}
+	res, err = http.Get("http://localhost:8102/css/style.css")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("ETag"); !strings.HasPrefix(got, "W/") {
+		t.Errorf("the location should send weak ETags, got %q\n", got)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	confFile := writeTestConf(t, `port = 8103`)
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	file, err := ioutil.ReadFile("testdata/www/localhost/index.html")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	size := len(file)
+	res, err := http.Get("http://localhost:8103/index.html")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	res.Body.Close()
+	etag := res.Header.Get("ETag")
+	if res.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("the response should have Accept-Ranges, got %q\n", res.Header.Get("Accept-Ranges"))
+	}
+	tests := []struct {
+		rng          string
+		ifRange      string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"bytes=0-4", "", 206, string(file[:5]), fmt.Sprintf("bytes 0-4/%d", size)},
+		{"bytes=-5", "", 206, string(file[size-5:]), fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size)},
+		{"bytes=0-4", etag, 206, string(file[:5]), fmt.Sprintf("bytes 0-4/%d", size)},
+		{"bytes=0-4", `"other"`, 200, string(file), ""},
+		{"bytes=0-4", "Mon, 01 Jan 2001 00:00:00 GMT", 200, string(file), ""},
+		{fmt.Sprintf("bytes=%d-", size), "", 416, "", fmt.Sprintf("bytes */%d", size)},
+		{"bytes=a-b", "", 200, string(file), ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://localhost:8103/index.html", nil)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		req.Header.Set("Range", test.rng)
+		if test.ifRange != "" {
+			req.Header.Set("If-Range", test.ifRange)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending the range %s: %s\n", test.rng, err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("the range %s returned %d but want %d\n", test.rng, res.StatusCode, test.code)
+		}
+		if test.body != "" && string(body) != test.body {
+			t.Errorf("the range %s returned %q but want %q\n", test.rng, body, test.body)
+		}
+		if got := res.Header.Get("Content-Range"); got != test.contentRange {
+			t.Errorf("the range %s returned the Content-Range %q but want %q\n", test.rng, got, test.contentRange)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "http://localhost:8103/index.html", nil)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	req.Header.Set("Range", "bytes=0-1, 3-4")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer res.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("multiple ranges should be sent as multipart/byteranges, got %q\n", res.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+	want := []struct {
+		body         string
+		contentRange string
+	}{
+		{string(file[0:2]), fmt.Sprintf("bytes 0-1/%d", size)},
+		{string(file[3:5]), fmt.Sprintf("bytes 3-4/%d", size)},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("error reading the part for %s: %s\n", w.contentRange, err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if string(body) != w.body || part.Header.Get("Content-Range") != w.contentRange {
+			t.Errorf("got the part %q with %q but want %q with %q\n", body, part.Header.Get("Content-Range"), w.body, w.contentRange)
+		}
+		if part.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Errorf("the part should have the type of the file, got %q\n", part.Header.Get("Content-Type"))
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("the body should only have two parts, got %v\n", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	root := t.TempDir()
+	static := filepath.Join(root, "static")
+	if err := os.Mkdir(static, 0755); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	bundle := strings.Repeat("console.log('hello, world');\n", 100)
+	if err := os.WriteFile(filepath.Join(static, "app.js"), []byte(bundle), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("precompressed"))
+	zw.Close()
+	if err := os.WriteFile(filepath.Join(static, "app.js.gz"), gz.Bytes(), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(static, "other.js"), []byte(bundle), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8104
+compression = on
+compression_min_size = 100
+location /static/ {
+    root = %s
+    compression_static = on
+}
+`, root))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	prefix := "/static"
+	tests := []struct {
+		uri            string
+		acceptEncoding string
+		encoding       string
+		body           string
+	}{
+		{prefix + "/other.js", "gzip, deflate", "gzip", bundle},
+		{prefix + "/other.js", "gzip;q=0.5, deflate", "deflate", bundle},
+		{prefix + "/other.js", "br", "", bundle},
+		{prefix + "/app.js", "gzip", "gzip", "precompressed"},
+		{prefix + "/app.js", "deflate", "deflate", bundle},
+		// too small to be compressed
+		{"/index.html", "gzip", "", "Hello, world"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://localhost:8104"+test.uri, nil)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending GET %s: %s\n", test.uri, err)
+		}
+		var body io.Reader = res.Body
+		switch res.Header.Get("Content-Encoding") {
+		case "gzip":
+			body, err = gzip.NewReader(res.Body)
+		case "deflate":
+			body, err = zlib.NewReader(res.Body)
+		}
+		if err != nil {
+			t.Fatalf("error reading the body of %s: %s\n", test.uri, err)
+		}
+		b, _ := ioutil.ReadAll(body)
+		res.Body.Close()
+		if got := res.Header.Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("GET %s with %q was encoded with %q but want %q\n", test.uri, test.acceptEncoding, got, test.encoding)
+		}
+		if strings.TrimSpace(string(b)) != strings.TrimSpace(test.body) {
+			t.Errorf("GET %s with %q returned the wrong body %q\n", test.uri, test.acceptEncoding, b)
+		}
+		if strings.HasSuffix(test.uri, ".js") && res.Header.Get("Vary") != "Accept-Encoding" {
+			t.Errorf("GET %s should vary by Accept-Encoding, got %q\n", test.uri, res.Header.Get("Vary"))
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	confFile := writeTestConf(t, `port = 8105
+location /limited/ {
+    limit_req = 1r/m burst=1
+}
+`)
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	tests := []struct {
+		uri  string
+		code int
+	}{
+		{"/limited/", 404},
+		{"/limited/", 404},
+		{"/limited/", 429},
+		{"/index.html", 200},
+		{"/limited/", 429},
+	}
+	for i, test := range tests {
+		res, err := http.Get("http://localhost:8105" + test.uri)
+		if err != nil {
+			t.Fatalf("error sending GET %s: %s\n", test.uri, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("GET #%d %s returned %d but want %d\n", i+1, test.uri, res.StatusCode, test.code)
+		}
+		if test.code == 429 {
+			if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err != nil || secs < 1 || secs > 60 {
+				t.Errorf("the 429 response should have Retry-After, got %q\n", res.Header.Get("Retry-After"))
+			}
+		}
+	}
+}
+
+func TestConnectionLimit(t *testing.T) {
+	confFile := writeTestConf(t, `port = 8119
+limit_conn = 2
+`)
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	// the connections count even when they don't send a request
+	idle := make([]net.Conn, 0)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "localhost:8119")
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		defer conn.Close()
+		idle = append(idle, conn)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn, err := net.Dial("tcp", "localhost:8119")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("error reading the response of the third connection: %s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 429 || res.Header.Get("Retry-After") == "" {
+		t.Errorf("expected a 429 with Retry-After but got %d %q\n", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+
+	// closing one of them makes room for another one
+	idle[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	res, err = http.Get("http://localhost:8119/")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected a 200 once a connection was closed but got %d\n", res.StatusCode)
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	confFile := writeTestConf(t, `port = 8106
+header_timeout = 1s
+body_timeout = 1s
+max_request_line = 1k
+max_headers = 5
+`)
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+
+	tests := []struct {
+		name    string
+		payload string
+		code    int
+	}{
+		// the headers never end
+		{"slow headers", "GET / HTTP/1.1\r\nHost: localhost\r\n", 408},
+		// the body is shorter than its length
+		{"slow body", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc", 408},
+		{"long request line", "GET /" + strings.Repeat("a", 2048) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", 414},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: localhost\r\n" + strings.Repeat("X-Header: a\r\n", 5) + "\r\n", 431},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", "localhost:8106")
+		if err != nil {
+			t.Fatalf("error connecting to the server: %s\n", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(conn, test.payload)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Errorf("%s: error reading the response: %s\n", test.name, err)
+			conn.Close()
+			continue
+		}
+		res.Body.Close()
+		conn.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("%s: got a %d response but want %d\n", test.name, res.StatusCode, test.code)
+		}
+	}
+}
+
+func TestRunsAsTheConfiguredUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can switch to another user")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("the nobody user does not exist")
+	}
+	// the files must be readable by nobody, but only root can write the logs
+	root, err := os.MkdirTemp("", "httpd")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer os.RemoveAll(root)
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("nobody"), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	accessLog := filepath.Join(root, "access.log")
+	confFile := filepath.Join(root, "httpd.conf")
+	conf := fmt.Sprintf("user = nobody\nport = 8107\nroot = %s\nindex = index.html\naccess_log = %s\n", root, accessLog)
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	get := func(port int) {
+		res, err := http.Get(fmt.Sprintf("http://localhost:%d/", port))
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 || string(body) != "nobody" {
+			t.Errorf("the server should still serve the files, got %d %q\n", res.StatusCode, body)
+		}
+	}
+	uid := func(pid int) string {
+		status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+		if err != nil {
+			t.Skip("the user of the process can't be checked")
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "Uid:" {
+				return fields[1]
+			}
+		}
+		return ""
+	}
+	workers := func() []int {
+		tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", cmd.Process.Pid))
+		var pids []int
+		for _, task := range tasks {
+			b, _ := os.ReadFile(task)
+			for _, f := range strings.Fields(string(b)) {
+				pid, _ := strconv.Atoi(f)
+				pids = append(pids, pid)
+			}
+		}
+		if len(pids) == 0 {
+			t.Skip("the workers of the master can't be listed")
+		}
+		return pids
+	}
+	get(8107)
+	// the master keeps running as root to reload and to reopen the logs
+	if id := uid(cmd.Process.Pid); id != "0" {
+		t.Errorf("the master should run as root, got the uid %s\n", id)
+	}
+	started := workers()
+	for _, pid := range started {
+		if id := uid(pid); id != u.Uid {
+			t.Errorf("the worker should run as %s, got the uid %s\n", u.Uid, id)
+		}
+	}
+	// nobody can't create the new log
+	if err := os.Rename(accessLog, accessLog+".1"); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := cmd.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatalf("error sending SIGUSR1: %s\n", err)
+	}
+	time.Sleep(time.Second)
+	get(8107)
+	time.Sleep(100 * time.Millisecond)
+	if b, err := os.ReadFile(accessLog); err != nil || !strings.Contains(string(b), "GET / ") {
+		t.Errorf("the access log should be reopened, got %q (%v)\n", b, err)
+	}
+	// and it can't listen on a port below 1024
+	conf = strings.Replace(conf, "port = 8107", "port = 8107, 82", 1)
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := cmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("error sending SIGHUP: %s\n", err)
+	}
+	time.Sleep(time.Second)
+	get(82)
+	for _, pid := range workers() {
+		if id := uid(pid); id != u.Uid {
+			t.Errorf("the reloaded worker should run as %s, got the uid %s\n", u.Uid, id)
+		}
+		for _, old := range started {
+			if pid == old {
+				t.Errorf("the worker %d should be replaced\n", pid)
+			}
+		}
+	}
+}
+
+func TestRefusesToRunAsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the tests are not run by root")
+	}
+	confFile := filepath.Join(t.TempDir(), "httpd.conf")
+	if err := os.WriteFile(confFile, []byte("port = 8108\n"), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := waitTestServer(cmd, 5*time.Second); err == nil {
+		t.Errorf("httpd should fail to start as root without a user\n")
+	}
+	if out, err := exec.Command("./httpd", "-t", "-c", confFile).CombinedOutput(); err == nil {
+		t.Errorf("httpd -t should fail as root without a user\n%s\n", out)
+	}
+}
+
+func TestMasterAndWorkers(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "httpd.pid")
+	confFile := writeTestConf(t, "port = 8109\nworkers = 2\nshutdown_timeout = 2s\npid_file = "+pidFile+"\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	if pid, err := readPidFile(pidFile); err != nil || pid != cmd.Process.Pid {
+		t.Errorf("the pid file should have the pid of the master %d, got %d (%v)\n", cmd.Process.Pid, pid, err)
+	}
+	get := func() {
+		res, err := http.Get("http://localhost:8109/")
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("expected a 200 response, got: %d\n", res.StatusCode)
+		}
+	}
+	workers := func() []int {
+		// the children are listed by the thread that started them
+		tasks, _ := filepath.Glob(fmt.Sprintf("/proc/%d/task/*/children", cmd.Process.Pid))
+		if len(tasks) == 0 {
+			t.Skip("the workers of the master can't be listed")
+		}
+		var pids []int
+		for _, task := range tasks {
+			b, _ := os.ReadFile(task)
+			for _, f := range strings.Fields(string(b)) {
+				pid, _ := strconv.Atoi(f)
+				pids = append(pids, pid)
+			}
+		}
+		sort.Ints(pids)
+		return pids
+	}
+	get()
+	started := workers()
+	if len(started) != 2 {
+		t.Fatalf("the master should start 2 workers, got %v\n", started)
+	}
+	// a worker that crashes is started again
+	if err := syscall.Kill(started[0], syscall.SIGKILL); err != nil {
+		t.Fatalf("error killing the worker: %s\n", err)
+	}
+	// it crashed right after starting, so it's restarted after a delay
+	time.Sleep(workerRestartDelay + 500*time.Millisecond)
+	restarted := workers()
+	if len(restarted) != 2 || restarted[0] == started[0] && restarted[1] == started[1] {
+		t.Errorf("the killed worker should be restarted, got %v before and %v after\n", started, restarted)
+	}
+	get()
+	// the workers are replaced on a reload
+	if out, err := exec.Command("./httpd", "-c", confFile, "-s", "reload").CombinedOutput(); err != nil {
+		t.Fatalf("httpd -s reload failed: %s\n%s\n", err, out)
+	}
+	time.Sleep(time.Second)
+	reloaded := workers()
+	if len(reloaded) != 2 {
+		t.Errorf("the master should have 2 workers after the reload, got %v\n", reloaded)
+	}
+	for _, pid := range reloaded {
+		for _, old := range restarted {
+			if pid == old {
+				t.Errorf("the worker %d should be stopped after the reload\n", pid)
+			}
+		}
+	}
+	get()
+	if out, err := exec.Command("./httpd", "-c", confFile, "-s", "stop").CombinedOutput(); err != nil {
+		t.Fatalf("httpd -s stop failed: %s\n%s\n", err, out)
+	}
+	if err := waitTestServer(cmd, 5*time.Second); err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if _, err := os.Stat(pidFile); err == nil {
+		t.Errorf("the pid file should be removed when the server stops\n")
+	}
+	if _, err := net.Dial("tcp", "localhost:8109"); err == nil {
+		t.Errorf("the workers should stop with the master\n")
+	}
+}
+
+func TestBinaryUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    int
+		options string
+	}{
+		{"single process", 8110, ""},
+		{"master and workers", 8111, "workers = 2\n"},
+	}
+	for _, test := range tests {
+		addr := fmt.Sprintf("localhost:%d", test.port)
+		pidFile := filepath.Join(t.TempDir(), "httpd.pid")
+		confFile := writeTestConf(t, fmt.Sprintf("port = %d\nshutdown_timeout = 5s\npid_file = %s\n%s", test.port, pidFile, test.options))
+		cmd, err := startTestServer(confFile)
+		if err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		defer cmd.Process.Kill()
+		// a request that is still being sent during the upgrade
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("error connecting to the server: %s\n", err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\n")
+		time.Sleep(100 * time.Millisecond)
+		if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+			t.Fatalf("error sending SIGUSR2: %s\n", err)
+		}
+		time.Sleep(time.Second)
+		pid, err := readPidFile(pidFile)
+		if err != nil || pid == cmd.Process.Pid {
+			t.Fatalf("%s: the pid file should have the pid of the new binary, got %d (%v)\n", test.name, pid, err)
+		}
+		defer syscall.Kill(pid, syscall.SIGKILL)
+		res, err := http.Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatalf("%s: error sending GET request to the new binary: %s\n", test.name, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("%s: expected a 200 response from the new binary, got: %d\n", test.name, res.StatusCode)
+		}
+		// the old binary finishes the request before exiting
+		fmt.Fprintf(conn, "Host: localhost\r\nConnection: close\r\n\r\n")
+		res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("%s: error reading the response of the in-flight request: %s\n", test.name, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("%s: expected a 200 response from the old binary, got: %d\n", test.name, res.StatusCode)
+		}
+		if err := waitTestServer(cmd, 5*time.Second); err != nil {
+			t.Errorf("%s: %s\n", test.name, err)
+		}
+		if out, err := exec.Command("./httpd", "-c", confFile, "-s", "stop").CombinedOutput(); err != nil {
+			t.Fatalf("%s: httpd -s stop failed: %s\n%s\n", test.name, err, out)
+		}
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat(pidFile); err != nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if _, err := os.Stat(pidFile); err == nil {
+			t.Errorf("%s: the new binary did not stop\n", test.name)
+		}
+	}
+}
+
+func TestFailedUpgrade(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "httpd.pid")
+	confFile := writeTestConf(t, "port = 8112\npid_file = "+pidFile+"\n")
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	// the new binary can't start with a broken configuration
+	if err := os.WriteFile(confFile, []byte("port = 8112\nunknown = on\n"), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatalf("error sending SIGUSR2: %s\n", err)
+	}
+	time.Sleep(time.Second)
+	if pid, err := readPidFile(pidFile); err != nil || pid != cmd.Process.Pid {
+		t.Errorf("the pid file should still have the pid of the old binary %d, got %d (%v)\n", cmd.Process.Pid, pid, err)
+	}
+	res, err := http.Get("http://localhost:8112/")
+	if err != nil {
+		t.Fatalf("the old binary should keep running: %s\n", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("expected a 200 response, got: %d\n", res.StatusCode)
+	}
+}
+
+func TestAutoindex(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"a.txt":         "hello",
+		"big.bin":       strings.Repeat("x", 1000),
+		".secret":       "hidden",
+		"sub/b.txt":     "world",
+		"private/c.txt": "private",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatalf("%s\n", err)
+		}
+	}
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8113
+root = %s
+autoindex = on
+location /private/ {
+    autoindex = off
+}
+`, root))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(uri, accept string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", "http://localhost:8113"+uri, nil)
+		if err != nil {
+			t.Fatalf("error creating GET request: %s\n", err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := get("/", "")
+	if res.StatusCode != 200 || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("expected an html listing, got %d %s\n", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{`href="./a.txt"`, `href="./big.bin"`, `href="./sub/"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("the listing should have %q\n%s\n", want, body)
+		}
+	}
+	if strings.Contains(body, ".secret") {
+		t.Errorf("the listing should not have the hidden files\n%s\n", body)
+	}
+
+	jsonTests := []struct {
+		uri  string
+		want []string
+	}{
+		{"/", []string{"private", "sub", "a.txt", "big.bin"}},
+		{"/?sort=size&order=desc", []string{"sub", "private", "big.bin", "a.txt"}},
+		{"/sub/", []string{"b.txt"}},
+	}
+	for _, test := range jsonTests {
+		res, body := get(test.uri, "application/json")
+		if res.StatusCode != 200 || res.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("GET %s: expected a json listing, got %d %s\n", test.uri, res.StatusCode, res.Header.Get("Content-Type"))
+			continue
+		}
+		var entries []struct {
+			Name string `json:"name"`
+			Dir  bool   `json:"dir"`
+			Size int64  `json:"size"`
+		}
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			t.Errorf("GET %s: invalid json listing: %s\n%s\n", test.uri, err, body)
+			continue
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("GET %s: expected the entries %v, got %v\n", test.uri, test.want, names)
+		}
+	}
+
+	res, _ = get("/sub?a=1", "")
+	if res.StatusCode != 301 || res.Header.Get("Location") != "/sub/?a=1" {
+		t.Errorf("a directory without a slash should be redirected, got %d %q\n", res.StatusCode, res.Header.Get("Location"))
+	}
+	if res, _ = get("/private/", ""); res.StatusCode != 403 {
+		t.Errorf("a directory without autoindex should not be listed, got %d\n", res.StatusCode)
+	}
+}
+
+func TestBasicAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	htpasswd := filepath.Join(dir, "htpasswd")
+	accessLog := filepath.Join(dir, "access.log")
+	// the password of alice is "secret" (sha1), the one of bob is "hunter2" (bcrypt)
+	users := "alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:$2y$05$afNf4PEygLr0oILGGumWF.Nege8cTmvo0NOMhLjiF1a6qyF9.re9y\n"
+	if err := os.WriteFile(htpasswd, []byte(users), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	confFile := writeTestConf(t, fmt.Sprintf(`port = 8114
+log_format = $remote_user $request_uri
+access_log = %s
+auth_basic = Staging area
+auth_basic_user_file = %s
+location = /index.html {
+    auth_basic = off
+}
+`, accessLog, htpasswd))
+	cmd, err := startTestServer(confFile)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	defer cmd.Process.Kill()
+	get := func(uri, user, password string) *http.Response {
+		req, err := http.NewRequest("GET", "http://localhost:8114"+uri, nil)
+		if err != nil {
+			t.Fatalf("error creating GET request: %s\n", err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error sending GET request: %s\n", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return res
+	}
+	tests := []struct {
+		uri      string
+		user     string
+		password string
+		code     int
+	}{
+		{"/", "", "", 401},
+		{"/", "alice", "secret", 200},
+		{"/", "alice", "wrong", 401},
+		{"/", "bob", "hunter2", 200},
+		{"/", "carol", "secret", 401},
+		{"/index.html", "", "", 200},
+	}
+	for _, test := range tests {
+		res := get(test.uri, test.user, test.password)
+		if res.StatusCode != test.code {
+			t.Errorf("GET %s as %q: expected a %d response, got %d\n", test.uri, test.user, test.code, res.StatusCode)
+		}
+		if test.code == 401 && res.Header.Get("WWW-Authenticate") != `Basic realm="Staging area", charset="UTF-8"` {
+			t.Errorf("GET %s as %q: wrong WWW-Authenticate header %q\n", test.uri, test.user, res.Header.Get("WWW-Authenticate"))
+		}
+	}
+	// the file is read again when it changes
+	if err := os.WriteFile(htpasswd, []byte("carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(htpasswd, later, later)
+	if res := get("/", "carol", "secret"); res.StatusCode != 200 {
+		t.Errorf("the new user should be allowed, got %d\n", res.StatusCode)
+	}
+	if res := get("/", "alice", "secret"); res.StatusCode != 401 {
+		t.Errorf("the removed user should not be allowed, got %d\n", res.StatusCode)
+	}
+	time.Sleep(100 * time.Millisecond)
+	b, _ := ioutil.ReadFile(accessLog)
+	if !strings.Contains(string(b), "alice /\n") || !strings.Contains(string(b), "- /index.html\n") {
+		t.Errorf("the access log should have the users of the requests\n%s\n", b)
+	}
+}
+
+func TestGetPortsToListen(t *testing.T) {
+	tests := []struct {
+		c    *Conf
+		want []int
+	}{
+		{
+			&Conf{
+				User:  "foo",
+				Group: "bar",
+				DefaultServer: &ServerConf{
+					Names: []string{"one", "two", "three"},
+					Root:  "/foo/bar",
+					Ports: []int{80, 8080, 8081},
+				},
+			},
+			[]int{80, 8080, 8081},
+		},
+		{
+			&Conf{
+				User:  "baz",
+				Group: "bazzer",
+				DefaultServer: &ServerConf{
+					Names: []string{"bee", "sting", "print"},
+					Root:  "/tmp/server",
+					Ports: []int{80, 443, 80, 80, 9090, 9090, 9091},
+				},
+			},
+			[]int{80, 443, 9090, 9091},
+		},
+	}
+
+	for _, test := range tests {
+		ports, err := getPortsToListen(test.c)
+		if err != nil {
+			t.Errorf("getPortsToListen() returned an error: %s\n", err)
+		}
+		if !reflect.DeepEqual(ports, test.want) {
+			t.Errorf("getPortsToListen() returned the wrong ports, got %v but want %v\n", ports, test.want)
+		}
+	}
+}
+
+func TestGetPortsToListenWithNoPorts(t *testing.T) {
+	c := &Conf{
+		User:  "foo",
+		Group: "bar",
+		DefaultServer: &ServerConf{
+			Names: []string{"one", "two", "three"},
+			Root:  "/foo/bar",
+			Ports: []int{},
+		},
+	}
+	if _, err := getPortsToListen(c); err == nil {
+		t.Errorf("getPortsToListen() should return an error\n")
+	}
+}
+
+// writeTestConf writes a configuration file that serves
+// testdata/www/localhost with the options that are given
+func writeTestConf(t *testing.T, options string) string {
+	root, err := filepath.Abs("testdata/www/localhost")
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	confFile := filepath.Join(t.TempDir(), "httpd.conf")
+	conf := fmt.Sprintf("root = %s\nindex = index.html\n%s%s", root, userConf(), options)
+	if err := os.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		t.Fatalf("error writing the configuration: %s\n", err)
+	}
+	return confFile
+}
+
+// userConf returns the user and the group options of the user that runs
+// the tests, the files of the tests may not be readable by anyone else
+func userConf() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	conf := "user = " + u.Username + "\n"
+	if g, err := user.LookupGroupId(u.Gid); err == nil {
+		conf += "group = " + g.Name + "\n"
+	}
+	return conf
+}
+
+// keepUserConf writes a copy of the configuration file
+// that runs the server as the user that runs the tests
+func keepUserConf(confFile string) (string, error) {
+	b, err := os.ReadFile(confFile)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "httpd")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, filepath.Base(confFile))
+	if err := os.WriteFile(name, append(b, "\n"+userConf()...), 0644); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// writeTestCert writes a self-signed certificate for the name
+// and its key, it returns the files of both of them
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0644); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	return certFile, keyFile
+}
+
+// startTestServer starts the httpd binary built by TestMain
+func startTestServer(confPath string) (*exec.Cmd, error) {
+	cmd := exec.Command("./httpd", "-c", confPath)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("problem starting httpd: %s", err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	return cmd, nil
+}
+
+// waitTestServer waits for the process to exit successfully
+func waitTestServer(cmd *exec.Cmd, timeout time.Duration) error {
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("httpd did not exit successfully: %s", err)
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("httpd did not exit after %s", timeout)
 	}
 }
 
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// serves the static files found under the root of a server
+
+const defaultContentType = "application/octet-stream"
+
+var contentTypes = map[string]string{
+	"html":  "text/html; charset=utf-8",
+	"htm":   "text/html; charset=utf-8",
+	"css":   "text/css; charset=utf-8",
+	"md":    "text/markdown; charset=utf-8",
+	"txt":   "text/plain; charset=utf-8",
+	"xml":   "text/xml; charset=utf-8",
+	"csv":   "text/csv; charset=utf-8",
+	"js":    "application/javascript",
+	"mjs":   "application/javascript",
+	"json":  "application/json",
+	"wasm":  "application/wasm",
+	"pdf":   "application/pdf",
+	"zip":   "application/zip",
+	"gz":    "application/gzip",
+	"tar":   "application/x-tar",
+	"bmp":   "image/bmp",
+	"gif":   "image/gif",
+	"jpg":   "image/jpeg",
+	"jpeg":  "image/jpeg",
+	"ico":   "image/x-icon",
+	"png":   "image/png",
+	"webp":  "image/webp",
+	"tiff":  "image/tiff",
+	"svg":   "image/svg+xml",
+	"mp3":   "audio/mpeg",
+	"ogg":   "audio/ogg",
+	"wav":   "audio/wav",
+	"mp4":   "video/mp4",
+	"mpeg":  "video/mpeg",
+	"webm":  "video/webm",
+	"mov":   "video/quicktime",
+	"ttf":   "font/ttf",
+	"otf":   "font/otf",
+	"woff":  "font/woff",
+	"woff2": "font/woff2",
+}
+
+var (
+	errFileNotFound  = errors.New("file not found")
+	errFileForbidden = errors.New("file access forbidden")
+	// the directory is returned with it, it can be listed
+	errNoIndexPage = fmt.Errorf("%w, the directory has no index page", errFileForbidden)
+)
+
+// resolveFile maps the uri of the request to a file under the root
+// of the server, for directories every index page is tried in order
+func resolveFile(uri string, srv *ServerConf) (string, error) {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return "", errFileNotFound
+	}
+	// cleaning the path as an absolute one makes sure
+	// that it can never go above the root of the server
+	p := path.Clean("/" + u.Path)
+	name := filepath.Join(srv.Root, filepath.FromSlash(p))
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", fileError(err)
+	}
+	if !underRoot(name, srv.Root) {
+		return "", errFileForbidden
+	}
+	if !info.IsDir() {
+		return name, nil
+	}
+	for _, index := range srv.IndexPages {
+		indexName := filepath.Join(name, index)
+		info, err := os.Stat(indexName)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return "", fileError(err)
+		}
+		if !info.IsDir() {
+			if !underRoot(indexName, srv.Root) {
+				return "", errFileForbidden
+			}
+			return indexName, nil
+		}
+	}
+	// a directory without any index page is only listed with autoindex
+	return name, errNoIndexPage
+}
+
+// underRoot reports whether the file is still under the root once the
+// symlinks of both are followed, a link that points anywhere else
+// could be used to send any file of the system
+func underRoot(name, root string) bool {
+	realName, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return false
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(realRoot, realName)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// fileError converts an error from the file system
+// into one of the errors that the server knows about
+func fileError(err error) error {
+	if errors.Is(err, fs.ErrPermission) {
+		return errFileForbidden
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return errFileNotFound
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		// "not a directory" errors and friends
+		return errFileNotFound
+	}
+	return err
+}
+
+// errorPageResponse returns a response with the error page of the server
+// for the status code, it's nil if the server doesn't have a page for it
+func errorPageResponse(srv *ServerConf, code int) *Response {
+	if srv == nil {
+		return nil
+	}
+	page := srv.errorPage(code)
+	if page == "" {
+		return nil
+	}
+	// the page is always relative to the root of the server
+	name := filepath.Join(srv.Root, filepath.FromSlash(path.Clean("/"+page)))
+	f, err := os.Open(name)
+	if err != nil {
+		log.Printf("error page %s could not be opened: %s", name, err)
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		log.Printf("error page %s is not a file", name)
+		return nil
+	}
+	headers := make(textproto.MIMEHeader)
+	headers.Set("Content-Type", getContentType(name))
+	return NewResponse(code, headers, f, info.Size())
+}
+
+func getContentType(name string) string {
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	if ct, ok := contentTypes[strings.ToLower(ext)]; ok {
+		return ct
+	}
+	return defaultContentType
+}
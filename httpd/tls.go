@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TLS termination on the ports marked with "tls", the certificate
+// of every connection is chosen by the server name that the client
+// asks for (SNI)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+const defaultTLSMinVersion = tls.VersionTLS12
+
+// certificates are the certificates of every server,
+// by the files of the certificate and of its key
+type certificates map[string]*tls.Certificate
+
+func certificateKey(srv *ServerConf) string {
+	return srv.SSLCertificate + "\x00" + srv.SSLCertificateKey
+}
+
+// loadCertificates loads the certificates of every server of the configuration
+// and checks that every port with TLS has at least one of them
+func loadCertificates(conf *Conf) (certificates, error) {
+	certs := make(certificates)
+	for _, srv := range conf.servers() {
+		if srv.SSLCertificate == "" {
+			continue
+		}
+		key := certificateKey(srv)
+		if _, ok := certs[key]; ok {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(srv.SSLCertificate, srv.SSLCertificateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading certificate %s: %w", srv.SSLCertificate, err)
+		}
+		certs[key] = &cert
+	}
+	for port := range tlsPorts(conf) {
+		if findTLSServer(conf, port, "") == nil {
+			return nil, fmt.Errorf("no certificate for the tls port %d", port)
+		}
+	}
+	return certs, nil
+}
+
+// tlsPorts returns the ports that are marked with "tls" by any server
+func tlsPorts(conf *Conf) map[int]bool {
+	ports := make(map[int]bool)
+	for _, srv := range conf.servers() {
+		for _, p := range srv.TLSPorts {
+			ports[p] = true
+		}
+	}
+	return ports
+}
+
+// findTLSServer returns the server to use for the handshake of a connection
+// on the port, it's the one named after the server name if it has a
+// certificate, or the first server on the port that has one otherwise
+func findTLSServer(conf *Conf, port int, serverName string) *ServerConf {
+	if srv := findServer(conf, port, serverName); srv != nil && srv.SSLCertificate != "" {
+		return srv
+	}
+	for _, srv := range conf.servers() {
+		if srv.SSLCertificate != "" && srv.listensOn(port) {
+			return srv
+		}
+	}
+	return nil
+}
+
+// tlsConfig returns the configuration of a TLS listener on the port
+func (s *Server) tlsConfig(port int) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			conf := s.conf.Load()
+			srv := findTLSServer(conf, port, strings.ToLower(hello.ServerName))
+			if srv == nil {
+				return nil, fmt.Errorf("no certificate for %s on port %d", hello.ServerName, port)
+			}
+			cert := (*s.certs.Load())[certificateKey(srv)]
+			if cert == nil {
+				return nil, fmt.Errorf("certificate %s is not loaded", srv.SSLCertificate)
+			}
+			return &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				MinVersion:   srv.tlsMinVersion(),
+				CipherSuites: parseCiphers(srv.TLSCiphers),
+			}, nil
+		},
+	}
+}
+
+// parseCiphers returns the ids of the cipher suites in the list, nil
+// means that the default ones are used, unknown names are ignored
+func parseCiphers(ciphers string) []uint16 {
+	if ciphers == "" {
+		return nil
+	}
+	ids := make([]uint16, 0)
+	for _, name := range strings.Split(ciphers, ",") {
+		if id, ok := cipherID(strings.TrimSpace(name)); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func cipherID(name string) (uint16, bool) {
+	for _, c := range tls.CipherSuites() {
+		if c.Name == name {
+			return c.ID, true
+		}
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		if c.Name == name {
+			return c.ID, true
+		}
+	}
+	return 0, false
+}
+
+// httpsRedirectResponse redirects the request to the same uri on the
+// first tls port of the server (or the default one if it doesn't have any)
+func httpsRedirectResponse(srv *ServerConf, host string, req *Request) *Response {
+	if host == "" && len(srv.Names) > 0 {
+		host = srv.Names[0]
+	}
+	location := "https://" + host
+	if len(srv.TLSPorts) > 0 && srv.TLSPorts[0] != 443 {
+		location += fmt.Sprintf(":%d", srv.TLSPorts[0])
+	}
+	return redirectResponse(StatusMovedPermanently, location+req.RequestURI())
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the binary is upgraded (on SIGUSR2) by starting it again with the
+// listeners of the running server as open files, the new server tells the
+// old one when it's listening and then the old one gracefully shuts down.
+// The old server keeps running when the new one can't start
+
+// set to the file that the new server writes to once it's listening
+const upgradeEnv = "HTTPD_UPGRADE"
+
+// the listeners are the first files passed to another process
+const firstListenerFd = 3
+
+// how long the new server has to start listening
+const upgradeTimeout = 10 * time.Second
+
+// passListeners adds the listener files to the files of the command and
+// returns the environment variable with their ports
+func passListeners(cmd *exec.Cmd, files map[int]*os.File) string {
+	ports := make([]int, 0, len(files))
+	for port := range files {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	names := make([]string, 0, len(ports))
+	for _, port := range ports {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, files[port])
+		names = append(names, strconv.Itoa(port))
+	}
+	return listenersEnv + "=" + strings.Join(names, ",")
+}
+
+// inheritedFiles returns the listener files passed by the
+// process that started this one, by port
+func inheritedFiles() (map[int]*os.File, error) {
+	files := make(map[int]*os.File)
+	ports := os.Getenv(listenersEnv)
+	// the processes started by this one get their own
+	os.Unsetenv(listenersEnv)
+	if ports == "" {
+		return files, nil
+	}
+	for i, p := range strings.Split(ports, ",") {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q in %s", p, listenersEnv)
+		}
+		files[port] = os.NewFile(uintptr(firstListenerFd+i), "listener-"+p)
+	}
+	return files, nil
+}
+
+// inheritedListeners returns the listeners passed by the
+// process that started this one, by port
+func inheritedListeners() (map[int]net.Listener, error) {
+	files, err := inheritedFiles()
+	if err != nil {
+		return nil, err
+	}
+	return fileListeners(files)
+}
+
+// fileListeners returns the listeners of the files, the files are closed
+func fileListeners(files map[int]*os.File) (map[int]net.Listener, error) {
+	listeners := make(map[int]net.Listener)
+	for port, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error using the listener of %d: %w", port, err)
+		}
+		listeners[port] = l
+	}
+	return listeners, nil
+}
+
+// inheritedFd returns the file descriptor in the environment variable,
+// or nil when it's not set
+func inheritedFd(env, name string) *os.File {
+	fd, err := strconv.Atoi(os.Getenv(env))
+	os.Unsetenv(env)
+	if err != nil || fd < firstListenerFd {
+		return nil
+	}
+	return os.NewFile(uintptr(fd), name)
+}
+
+func isUpgrade() bool {
+	return os.Getenv(upgradeEnv) != ""
+}
+
+// upgradeFile returns the file to tell the server that is being
+// upgraded that this one is listening, it's nil when there's no upgrade
+func upgradeFile() *os.File {
+	return inheritedFd(upgradeEnv, "upgrade")
+}
+
+// notifyUpgrade tells the server that is being upgraded that this one is listening
+func notifyUpgrade(f *os.File) {
+	if f == nil {
+		return
+	}
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// upgrade starts the binary with the listener files, it returns
+// once the new server is listening or it failed to start
+func upgrade(files map[int]*os.File) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	listeners := passListeners(cmd, files)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	cmd.Env = append(os.Environ(), listeners, upgradeEnv+"="+strconv.Itoa(firstListenerFd+len(files)))
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("error starting the new binary: %w", err)
+	}
+	// the new server is not waited for when it keeps running,
+	// it's adopted by init once this one exits
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		<-exited
+		return fmt.Errorf("the new binary did not start listening (%s)", cmd.ProcessState)
+	}
+	log.Printf("the new binary is running as %d", cmd.Process.Pid)
+	return nil
+}
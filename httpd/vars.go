@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// variables that can be used in the options of the configuration,
+// like $host or $request_uri
+
+// expandVars replaces every variable of the form $name or ${name}
+// with its value, unknown variables are left as they are
+func expandVars(s string, lookup func(name string) (string, bool)) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			b.WriteByte(s[i])
+			continue
+		}
+		name, n := varName(s[i+1:])
+		if name == "" {
+			b.WriteByte(s[i])
+			continue
+		}
+		if value, ok := lookup(name); ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(s[i : i+1+n])
+		}
+		i += n
+	}
+	return b.String()
+}
+
+// varName returns the name of the variable at the start
+// of s and how many bytes of s are part of it
+func varName(s string) (string, int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.IndexByte(s, '}')
+		if end == -1 {
+			return "", 0
+		}
+		return s[1:end], end + 1
+	}
+	n := 0
+	for n < len(s) && isVarChar(s[n]) {
+		n++
+	}
+	return s[:n], n
+}
+
+func isVarChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// requestVar returns the value of a variable that comes from the request
+func requestVar(req *Request, name string) (string, bool) {
+	if req == nil {
+		return "", false
+	}
+	switch name {
+	case "host":
+		host, _ := req.Host()
+		return host, true
+	case "request_uri":
+		return req.RequestURI(), true
+	case "uri":
+		return req.Path(), true
+	case "args", "query_string":
+		if u, err := url.ParseRequestURI(req.Uri); err == nil {
+			return u.RawQuery, true
+		}
+		return "", true
+	case "scheme":
+		if req.TLS {
+			return "https", true
+		}
+		return "http", true
+	case "request_method":
+		return req.Method, true
+	case "server_protocol":
+		return req.Proto(), true
+	case "request":
+		return req.Method + " " + req.RequestURI() + " " + req.Proto(), true
+	case "remote_user":
+		return req.remoteUser, true
+	case "remote_addr":
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			return host, true
+		}
+		return req.RemoteAddr, true
+	}
+	if strings.HasPrefix(name, "http_") {
+		header := strings.ReplaceAll(strings.TrimPrefix(name, "http_"), "_", "-")
+		return req.Headers.Get(header), true
+	}
+	return "", false
+}